@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// baseSource is whatever fetchBaseImage resolved bp.baseImage to, hiding
+// whether it came from a remote registry, a local daemon, an OCI layout
+// directory, or a tarball behind the same shape that fetchAndBuild already
+// used for *remote.Descriptor: a media type plus lazy Image/ImageIndex
+// accessors.
+type baseSource struct {
+	MediaType  types.MediaType
+	Image      func() (v1.Image, error)
+	ImageIndex func() (v1.ImageIndex, error)
+}
+
+func notAnImage(format string, args ...interface{}) func() (v1.Image, error) {
+	return func() (v1.Image, error) { return nil, fmt.Errorf(format, args...) }
+}
+
+func notAnIndex(format string, args ...interface{}) func() (v1.ImageIndex, error) {
+	return func() (v1.ImageIndex, error) { return nil, fmt.Errorf(format, args...) }
+}
+
+// fetchBaseImage resolves baseImage to a base image or index, dispatching on
+// a URI scheme prefix:
+//
+//	oci-layout://path[@digest-or-tag] - an OCI image layout directory on
+//	    disk, optionally selecting a single manifest within it by digest or
+//	    by the tag it was written to the layout under.
+//	docker-daemon://name:tag or daemon://name - an image already loaded
+//	    into the local Docker/podman/nerdctl daemon.
+//	tarball://path - an image saved with `docker save`/`skopeo` to a tarball
+//	    on disk.
+//	remote://name or no scheme - the default: a registry reference, fetched
+//	    over the network as before.
+//
+// Resolving locally cached bases this way lets mkctr run hermetically: CI
+// can pull the distroless base once, and every subsequent mkctr invocation
+// reuses it without another network round-trip.
+func fetchBaseImage(baseImage string, opts ...remote.Option) (*baseSource, error) {
+	if path, ok := strings.CutPrefix(baseImage, "oci-layout://"); ok {
+		return fetchBaseImageFromOCILayout(path)
+	}
+	if ref, ok := strings.CutPrefix(baseImage, "docker-daemon://"); ok {
+		return fetchBaseImageFromDaemon(ref)
+	}
+	if ref, ok := strings.CutPrefix(baseImage, "daemon://"); ok {
+		return fetchBaseImageFromDaemon(ref)
+	}
+	if path, ok := strings.CutPrefix(baseImage, "tarball://"); ok {
+		return fetchBaseImageFromTarball(path)
+	}
+	baseImage = strings.TrimPrefix(baseImage, "remote://")
+
+	baseRef, err := name.ParseReference(baseImage)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(baseRef, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &baseSource{
+		MediaType:  desc.MediaType,
+		Image:      desc.Image,
+		ImageIndex: desc.ImageIndex,
+	}, nil
+}
+
+// ociLayoutRefNameAnnotation is the annotation `layout.WithAnnotations`
+// conventionally carries a tag under, per the OCI image-layout spec's
+// "org.opencontainers.image.ref.name" convention.
+const ociLayoutRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// fetchBaseImageFromOCILayout reads a base from an OCI image layout
+// directory on disk, as written by `layout.Write` or `crane pull --format=oci`.
+// With no "@digest-or-tag" suffix the whole layout is treated as an index
+// (the common case for a multi-platform base); with one, the single
+// manifest it names is used instead, resolving it as a digest first and, if
+// that doesn't parse, as the tag it was written under.
+func fetchBaseImageFromOCILayout(spec string) (*baseSource, error) {
+	path, selector, hasSelector := strings.Cut(spec, "@")
+	lp, err := layout.FromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening OCI layout %q: %w", path, err)
+	}
+	if !hasSelector {
+		idx, err := lp.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("reading OCI layout %q: %w", path, err)
+		}
+		mt, err := idx.MediaType()
+		if err != nil {
+			return nil, fmt.Errorf("reading OCI layout %q media type: %w", path, err)
+		}
+		return &baseSource{
+			MediaType:  mt,
+			Image:      notAnImage("OCI layout %q is an index, not a single image", path),
+			ImageIndex: func() (v1.ImageIndex, error) { return idx, nil },
+		}, nil
+	}
+
+	h, err := ociLayoutResolveSelector(lp, path, selector)
+	if err != nil {
+		return nil, err
+	}
+	img, err := lp.Image(h)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v from OCI layout %q: %w", h, path, err)
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v media type: %w", h, err)
+	}
+	return &baseSource{
+		MediaType:  mt,
+		Image:      func() (v1.Image, error) { return img, nil },
+		ImageIndex: notAnIndex("OCI layout %q@%v is a single image, not an index", path, h),
+	}, nil
+}
+
+// ociLayoutResolveSelector resolves selector, the part of an
+// "oci-layout://path@selector" base image reference after the "@", to the
+// digest of the manifest it names: selector itself, if it parses as a
+// digest, or otherwise the manifest in lp's top-level index annotated with
+// selector as its "org.opencontainers.image.ref.name" tag.
+func ociLayoutResolveSelector(lp layout.Path, path, selector string) (v1.Hash, error) {
+	if h, err := v1.NewHash(selector); err == nil {
+		return h, nil
+	}
+	idx, err := lp.ImageIndex()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("reading OCI layout %q: %w", path, err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("reading OCI layout %q index: %w", path, err)
+	}
+	for _, m := range im.Manifests {
+		if m.Annotations[ociLayoutRefNameAnnotation] == selector {
+			return m.Digest, nil
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("OCI layout %q has no manifest tagged %q", path, selector)
+}
+
+// fetchBaseImageFromDaemon reads a base already loaded into the local
+// Docker/containerd daemon. Daemon images are never multi-platform indexes.
+func fetchBaseImageFromDaemon(ref string) (*baseSource, error) {
+	tag, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("parsing daemon image reference %q: %w", ref, err)
+	}
+	img, err := daemon.Image(tag)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q from daemon: %w", ref, err)
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("reading %q media type: %w", ref, err)
+	}
+	return &baseSource{
+		MediaType:  mt,
+		Image:      func() (v1.Image, error) { return img, nil },
+		ImageIndex: notAnIndex("daemon image %q is not a multi-platform index", ref),
+	}, nil
+}
+
+// fetchBaseImageFromTarball reads a base from a tarball on disk, as written
+// by `docker save` or `tarball.WriteToFile`. Tarballs are never
+// multi-platform indexes.
+func fetchBaseImageFromTarball(path string) (*baseSource, error) {
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading tarball %q: %w", path, err)
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("reading %q media type: %w", path, err)
+	}
+	return &baseSource{
+		MediaType:  mt,
+		Image:      func() (v1.Image, error) { return img, nil },
+		ImageIndex: notAnIndex("tarball %q is not a multi-platform index", path),
+	}, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestFetchBaseImageFromOCILayout(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "layout")
+	img, err := mutate.AppendLayers(empty.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex), mutate.IndexAddendum{Add: img})
+	if _, err := layout.Write(path, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// No digest: the whole layout is treated as an index.
+	src, err := fetchBaseImage("oci-layout://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.MediaType != types.OCIImageIndex {
+		t.Fatalf("MediaType = %v, want %v", src.MediaType, types.OCIImageIndex)
+	}
+	if _, err := src.ImageIndex(); err != nil {
+		t.Fatalf("ImageIndex(): %v", err)
+	}
+	if _, err := src.Image(); err == nil {
+		t.Fatal("Image() on an index-only layout: expected error, got nil")
+	}
+
+	// With a digest: the single manifest it names is used instead.
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err = fetchBaseImage(fmt.Sprintf("oci-layout://%s@%s", path, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Image(); err != nil {
+		t.Fatalf("Image(): %v", err)
+	}
+	if _, err := src.ImageIndex(); err == nil {
+		t.Fatal("ImageIndex() on a single-manifest reference: expected error, got nil")
+	}
+}
+
+func TestFetchBaseImageFromOCILayoutByTag(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "layout")
+	img, err := mutate.AppendLayers(empty.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex), mutate.IndexAddendum{
+		Add: img,
+		Descriptor: v1.Descriptor{
+			Annotations: map[string]string{"org.opencontainers.image.ref.name": "my-tag"},
+		},
+	})
+	if _, err := layout.Write(path, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := fetchBaseImage("oci-layout://" + path + "@my-tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Image(); err != nil {
+		t.Fatalf("Image(): %v", err)
+	}
+
+	if _, err := fetchBaseImage("oci-layout://" + path + "@no-such-tag"); err == nil {
+		t.Fatal("expected error resolving an unknown tag, got nil")
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// cacheDir returns the root directory mkctr caches compiled binaries and
+// layers under, creating it if necessary.
+func cacheDir() (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".cache")
+	}
+	dir := filepath.Join(base, "mkctr")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func goVersion() (string, error) {
+	out, err := exec.Command("go", "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("go version: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// findModuleRoot walks up from dir looking for the nearest go.mod, the way
+// the go command itself resolves a module root, and returns its directory.
+func findModuleRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no go.mod found above %v", dir)
+		}
+		dir = parent
+	}
+}
+
+// readModuleFiles returns root's go.mod contents plus its sibling go.sum (if
+// any). Together these pin every resolved module version used by a build.
+func readModuleFiles(root string) (goMod, goSum []byte, err error) {
+	goMod, err = os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil, nil, err
+	}
+	goSum, _ = os.ReadFile(filepath.Join(root, "go.sum"))
+	return goMod, goSum, nil
+}
+
+// localPackageDirs returns the directories of gopath and every package it
+// imports, transitively, that live inside moduleRoot: gopath's own source
+// plus any local packages it depends on. Dependencies resolved from outside
+// moduleRoot (stdlib, or third-party modules) are excluded, since those are
+// already pinned by go.mod/go.sum and immutable once fetched. env is passed
+// through so build-constrained files (GOOS/GOARCH-specific) are resolved
+// exactly as compileGoBinary's own `go build` invocation would see them.
+func localPackageDirs(gopath, moduleRoot string, env []string) ([]string, error) {
+	abs, err := filepath.Abs(gopath)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(moduleRoot, abs)
+	if err != nil {
+		return nil, err
+	}
+	pattern := "./" + filepath.ToSlash(rel)
+
+	cmd := exec.Command("go", "list", "-deps", "-f", "{{.Dir}}", pattern)
+	cmd.Dir = moduleRoot
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -deps %v: %w", gopath, err)
+	}
+	var dirs []string
+	for _, dir := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if dir == "" {
+			continue
+		}
+		if rel, err := filepath.Rel(moduleRoot, dir); err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// hashGoFiles writes the name and contents of every .go file directly
+// inside each of dirs (which is already sorted) to h, so an edit to any line
+// of source a build actually depends on changes the resulting hash.
+func hashGoFiles(h io.Writer, dirs []string) error {
+	for _, dir := range dirs {
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, e := range ents {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".go") {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "file=%s\n", path)
+			h.Write(b)
+		}
+	}
+	return nil
+}
+
+func envLookup(env []string, key string) string {
+	prefix := key + "="
+	for _, e := range env {
+		if rest, ok := strings.CutPrefix(e, prefix); ok {
+			return rest
+		}
+	}
+	return ""
+}
+
+// goBuildCacheKey fingerprints everything that affects compileGoBinary's
+// output for gopath: its resolved module versions (via go.mod/go.sum), the
+// contents of gopath's own source and every local package it imports, the
+// relevant build environment, and the requested ldflags/gotags/go version.
+func goBuildCacheKey(gopath string, env []string, ldflags, gotags string) (string, error) {
+	abs, err := filepath.Abs(gopath)
+	if err != nil {
+		return "", err
+	}
+	dir := abs
+	if fi, err := os.Stat(abs); err == nil && !fi.IsDir() {
+		dir = filepath.Dir(abs)
+	}
+	root, err := findModuleRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	goMod, goSum, err := readModuleFiles(root)
+	if err != nil {
+		return "", err
+	}
+	dirs, err := localPackageDirs(gopath, root, env)
+	if err != nil {
+		return "", err
+	}
+	gv, err := goVersion()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "gopath=%s\nldflags=%s\ngotags=%s\ngoversion=%s\n", gopath, ldflags, gotags, gv)
+	for _, k := range []string{"GOOS", "GOARCH", "GOARM", "GOAMD64", "GOMIPS"} {
+		fmt.Fprintf(h, "%s=%s\n", k, envLookup(env, k))
+	}
+	h.Write(goMod)
+	h.Write(goSum)
+	if err := hashGoFiles(h, dirs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func binaryCachePath(key string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bin", key), nil
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), "tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// layerCacheEntryMeta is the sidecar JSON stored next to a cached layer
+// blob, recording what tarball.LayerFromOpener would otherwise have had to
+// recompute by reading the blob back.
+type layerCacheEntryMeta struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffID"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType"`
+}
+
+// layerCache stores {digest, diffID, compressed blob} for layers already
+// built by layerFromFiles, keyed by a content hash of their inputs, so a
+// second build with identical files doesn't re-run tarball.LayerFromOpener.
+type layerCache struct {
+	dir string
+}
+
+func newLayerCache() (*layerCache, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "layers")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &layerCache{dir: dir}, nil
+}
+
+// key fingerprints files by the content of every entry (hashing regular
+// files, since their on-disk paths are often ephemeral temp files), plus
+// their destination, permissions, ownership, and the timestamp tsr resolves
+// each of them to (so a timestampSource build, where that varies per file,
+// still invalidates correctly).
+func (c *layerCache) key(files map[string]fileSpec, mediaType types.MediaType, tsr *timestampResolver) (string, error) {
+	type entry struct {
+		dst  string
+		spec fileSpec
+		sum  string
+		ts   string
+	}
+	var entries []entry
+	for src, spec := range files {
+		sum, err := sha256File(src)
+		if err != nil {
+			return "", err
+		}
+		ts, err := tsr.forEntry(src)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, entry{dst: spec.dst, spec: spec, sum: sum, ts: ts.Format(time.RFC3339Nano)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].dst < entries[j].dst })
+
+	h := sha256.New()
+	fmt.Fprintf(h, "mediaType=%s\n", mediaType)
+	for _, e := range entries {
+		fmt.Fprintf(h, "dst=%s mode=%o uid=%d gid=%d sum=%s ts=%s\n", e.dst, e.spec.mode, e.spec.uid, e.spec.gid, e.sum, e.ts)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *layerCache) blobPath(key string) string { return filepath.Join(c.dir, key+".tar.gz") }
+func (c *layerCache) metaPath(key string) string { return filepath.Join(c.dir, key+".json") }
+
+// get returns the cached layer for key, if present.
+func (c *layerCache) get(key string) (v1.Layer, bool) {
+	raw, err := os.ReadFile(c.metaPath(key))
+	if err != nil {
+		return nil, false
+	}
+	var meta layerCacheEntryMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(c.blobPath(key)); err != nil {
+		return nil, false
+	}
+	digest, err := v1.NewHash(meta.Digest)
+	if err != nil {
+		return nil, false
+	}
+	diffID, err := v1.NewHash(meta.DiffID)
+	if err != nil {
+		return nil, false
+	}
+	return &cachedLayer{
+		digest:    digest,
+		diffID:    diffID,
+		size:      meta.Size,
+		mediaType: types.MediaType(meta.MediaType),
+		blobPath:  c.blobPath(key),
+	}, true
+}
+
+// put stores layer under key for future reuse.
+func (c *layerCache) put(key string, layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.blobPath(key)); err != nil {
+		return err
+	}
+	meta := layerCacheEntryMeta{
+		Digest:    digest.String(),
+		DiffID:    diffID.String(),
+		Size:      size,
+		MediaType: string(mediaType),
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.metaPath(key), raw, 0644)
+}
+
+// layerFromFilesCached wraps layerFromFiles with the on-disk layer cache: on
+// a hit it returns the previously computed compressed blob directly,
+// skipping tarball.LayerFromOpener's gzip and digest work entirely.
+func layerFromFilesCached(logf logf, files map[string]fileSpec, layerMediaType types.MediaType, tsr *timestampResolver) (v1.Layer, error) {
+	lc, err := newLayerCache()
+	if err != nil {
+		return layerFromFiles(logf, files, layerMediaType, tsr)
+	}
+	key, err := lc.key(files, layerMediaType, tsr)
+	if err != nil {
+		return layerFromFiles(logf, files, layerMediaType, tsr)
+	}
+	if layer, ok := lc.get(key); ok {
+		logf("layer cache hit")
+		return layer, nil
+	}
+	layer, err := layerFromFiles(logf, files, layerMediaType, tsr)
+	if err != nil {
+		return nil, err
+	}
+	if err := lc.put(key, layer); err != nil {
+		logf("warning: failed to cache layer: %v", err)
+	}
+	return layer, nil
+}
+
+// cachedLayer is a v1.Layer backed by a previously-computed compressed blob
+// on disk, with its digest/diffID/size already known, so nothing needs to be
+// re-hashed or re-tarred to serve it.
+type cachedLayer struct {
+	digest, diffID v1.Hash
+	size           int64
+	mediaType      types.MediaType
+	blobPath       string
+}
+
+func (c *cachedLayer) Digest() (v1.Hash, error)            { return c.digest, nil }
+func (c *cachedLayer) DiffID() (v1.Hash, error)            { return c.diffID, nil }
+func (c *cachedLayer) Size() (int64, error)                { return c.size, nil }
+func (c *cachedLayer) MediaType() (types.MediaType, error) { return c.mediaType, nil }
+func (c *cachedLayer) Compressed() (io.ReadCloser, error)  { return os.Open(c.blobPath) }
+
+func (c *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	f, err := os.Open(c.blobPath)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{zr: zr, f: f}, nil
+}
+
+// gzipReadCloser closes both the gzip reader and the underlying file.
+type gzipReadCloser struct {
+	zr *gzip.Reader
+	f  *os.File
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) { return g.zr.Read(p) }
+
+func (g *gzipReadCloser) Close() error {
+	zerr := g.zr.Close()
+	ferr := g.f.Close()
+	if zerr != nil {
+		return zerr
+	}
+	return ferr
+}
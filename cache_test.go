@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// writeTestPackage writes a minimal buildable `package main` under
+// dir/cmd/foo, inside a module rooted at dir, and returns its gopath.
+func writeTestPackage(t *testing.T, dir, body string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/foo\n\ngo 1.21\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gopath := filepath.Join(dir, "cmd", "foo")
+	if err := os.MkdirAll(gopath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gopath, "main.go"), []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return gopath
+}
+
+func TestGoBuildCacheKeyStableAndDistinct(t *testing.T) {
+	dir := t.TempDir()
+	gopath := writeTestPackage(t, dir, "package main\n\nfunc main() {}\n")
+	env := []string{"GOOS=linux", "GOARCH=amd64"}
+
+	k1, err := goBuildCacheKey(gopath, env, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := goBuildCacheKey(gopath, env, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k2 {
+		t.Fatalf("same inputs produced different keys: %v != %v", k1, k2)
+	}
+
+	k3, err := goBuildCacheKey(gopath, []string{"GOOS=linux", "GOARCH=arm64"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k3 {
+		t.Fatal("different GOARCH produced the same key")
+	}
+}
+
+// TestGoBuildCacheKeyInvalidatesOnSourceEdit verifies that editing gopath's
+// own source changes its cache key, even though doing so touches neither
+// go.mod/go.sum nor the build environment: the bug this guards against is a
+// stale binary getting served from cache after a source edit.
+func TestGoBuildCacheKeyInvalidatesOnSourceEdit(t *testing.T) {
+	dir := t.TempDir()
+	gopath := writeTestPackage(t, dir, "package main\n\nfunc main() { println(\"v1\") }\n")
+	env := []string{"GOOS=linux", "GOARCH=amd64"}
+
+	k1, err := goBuildCacheKey(gopath, env, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(gopath, "main.go"), []byte("package main\n\nfunc main() { println(\"v2\") }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	k2, err := goBuildCacheKey(gopath, env, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k2 {
+		t.Fatal("editing gopath's source produced the same cache key")
+	}
+}
+
+func TestLayerCacheRoundTrip(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	src := filepath.Join(t.TempDir(), "bin")
+	if err := os.WriteFile(src, []byte("hello"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]fileSpec{src: {dst: "/usr/bin/hello", mode: 0o555}}
+	tsr := &timestampResolver{mode: timestampFixed, fixed: time.Unix(0, 0).UTC()}
+
+	lc, err := newLayerCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := lc.key(files, types.OCILayer, tsr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lc.get(key); ok {
+		t.Fatal("unexpected cache hit before anything was cached")
+	}
+
+	layer, err := layerFromFiles(noopLogf, files, types.OCILayer, tsr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDigest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.put(key, layer); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, ok := lc.get(key)
+	if !ok {
+		t.Fatal("expected cache hit after put")
+	}
+	gotDigest, err := cached.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotDigest != wantDigest {
+		t.Fatalf("cached layer digest = %v, want %v", gotDigest, wantDigest)
+	}
+}
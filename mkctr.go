@@ -20,6 +20,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,11 +29,11 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
 )
 
 type logf func(msg string, args ...interface{})
@@ -43,24 +44,6 @@ func withPrefix(f logf, prefix string) logf {
 	}
 }
 
-// parseFiles parses a comma-separated list of colon-separated pairs
-// into a map of filePathOnDisk -> filePathInContainer.
-func parseFiles(s string) (map[string]string, error) {
-	ret := map[string]string{}
-	if len(s) == 0 {
-		return ret, nil
-	}
-	for _, f := range strings.Split(s, ",") {
-		f = strings.TrimSpace(f)
-		fs := strings.Split(f, ":")
-		if len(fs) != 2 {
-			return nil, fmt.Errorf("unparseable file field %q", f)
-		}
-		ret[fs[0]] = fs[1]
-	}
-	return ret, nil
-}
-
 func parseRepos(reg, tags []string) ([]name.Tag, error) {
 	var refs []name.Tag
 	for _, rs := range reg {
@@ -76,36 +59,89 @@ func parseRepos(reg, tags []string) ([]name.Tag, error) {
 }
 
 type buildParams struct {
-	baseImage   string
-	goPaths     map[string]string
-	staticFiles map[string]string
-	imageRefs   []name.Tag
-	publish     bool
-	outPath     string
-	ldflags     string
-	gotags      string
-	target      string
-	verbose     bool
-	annotations map[string]string // OCI image annotations
+	baseImage     string
+	goPaths       map[string]fileSpec
+	staticFiles   map[string]fileSpec
+	imageRefs     []name.Tag
+	publish       bool
+	outPath       string
+	daemon        bool
+	ociLayoutPath string
+	ldflags       string
+	gotags        string
+	target        string
+	verbose       bool
+	annotations   map[string]string // OCI image annotations
+	sign          string            // "" or "none", "key", "keyless"
+	cosignKey     string            // path to an ECDSA PEM key, or a KMS URI; used by --sign=key
+	fulcioURL     string            // Fulcio instance used by --sign=keyless
+	rekorURL      string            // Rekor instance used by --sign=keyless
+	sbom          string            // "" or "none", "spdx", "syft", or a path to an SBOM file
+	provenance    bool              // --provenance: attach an in-toto SLSA provenance attestation
+	recipe        *recipe           // parsed --recipe=mkctr.yaml, if set; takes precedence over goPaths/staticFiles/ldflags/gotags
+	platforms     []v1.Platform     // --platforms restriction; empty means "whatever the base publishes"
+	timestamp     *timestampResolver
+	jobs          int // --jobs: max platforms to build concurrently
+}
+
+// buildArtifacts bundles the side outputs createImageForBase/
+// createImageFromRecipe produce alongside the image itself. Both are
+// optional attestations that have to be computed before the function's
+// temporary build directory is cleaned up — they describe the compiled
+// binaries, which won't exist on disk anymore by push time — so they're
+// threaded through the sink/signAndAttest layer as plain bytes rather than
+// regenerated later.
+type buildArtifacts struct {
+	// SPDXSBOM is the --sbom=spdx document for the image, nil unless
+	// requested.
+	SPDXSBOM []byte
+	// Provenance is the unsigned in-toto SLSA provenance statement for the
+	// image, nil unless --provenance is set. It's wrapped in a DSSE
+	// envelope and (optionally) signed at push time, by signAndAttest.
+	//
+	// It's filled in by fetchAndBuild, not by createImageForBase/
+	// createImageFromRecipe alongside the rest of buildArtifacts: its
+	// subject digest has to be the digest of the image actually pushed,
+	// which isn't final until fetchAndBuild has applied --annotations (and,
+	// for a multi-platform build, the trailing Cmd args) on top of what
+	// createImageForBase returns.
+	Provenance []byte
+	// Sources is the per-gopath source revision info --provenance needs to
+	// build Provenance, collected by createImageForBase/
+	// createImageFromRecipe while the compiled binaries still exist on
+	// disk. Not meaningful once Provenance has been filled in.
+	Sources []buildSource
 }
 
 func main() {
 	var (
-		baseImage   = flag.String("base", "", "base image for container")
-		gopaths     = flag.String("gopaths", "", "comma-separated list of go paths in src:dst form")
-		files       = flag.String("files", "", "comma-separated list of static files in src:dst form")
+		baseImage   = flag.String("base", "", "base image for container; a registry reference, or oci-layout://path[@digest-or-tag], docker-daemon://name:tag (or daemon://name), tarball://path to build hermetically from a local base")
+		gopaths     = flag.String("gopaths", "", "comma-separated list of go paths in src:dst[:mode[:uid[:gid]]] form, or @path-to-json-manifest")
+		files       = flag.String("files", "", "comma-separated list of static files in src:dst[:mode[:uid[:gid]]] form, or @path-to-json-manifest")
 		repos       = flag.String("repos", "", "comma-separated list of image registries")
 		tagArg      = flag.String("tags", "", "comma-separated tags")
 		ldflagsArg  = flag.String("ldflags", "", "the --ldflags value to pass to go")
 		gotags      = flag.String("gotags", "", "the --tags value to pass to go")
 		push        = flag.Bool("push", false, "publish the image")
 		outPath     = flag.String("out", "", "writes image(s) to a given folder")
+		daemonFlag  = flag.Bool("daemon", false, "load the image(s) into a local Docker/containerd daemon")
+		ociLayout   = flag.String("oci-layout", "", "writes image(s) as an OCI image layout to a given folder")
 		target      = flag.String("target", "", "build for a specific env (options: flyio, local)")
 		verbose     = flag.Bool("v", false, "verbose build output")
 		annotations = flag.String("annotations", "", `OCI image annotations https://github.com/opencontainers/image-spec/blob/main/annotations.md.
 		Annotations must be comma separated key=value pairs, i.e key1=val1,key2=val2. For a single image manifest annotations will get added to the image manifest.
 		For an image index (a multi-platform manifest list) annotations will get added to each image manifest as well as the image index.
 		Annotations with empty values are not supported.`)
+		sign       = flag.String("sign", "", `sign pushed images and indexes: "key" to sign with --cosign-key, "keyless" to sign with an ephemeral key and a Fulcio-issued certificate, or "none"`)
+		cosignKey  = flag.String("cosign-key", "", "path to an ECDSA PEM private key (or KMS URI) used by --sign=key")
+		fulcioURL  = flag.String("fulcio-url", defaultFulcioURL, "Fulcio instance used by --sign=keyless")
+		rekorURL   = flag.String("rekor-url", defaultRekorURL, "Rekor instance used by --sign=keyless")
+		sbom       = flag.String("sbom", "", `attach an SBOM to pushed images: "spdx" to self-generate one from the injected files and push it as an OCI 1.1 referrer artifact, "syft" to generate one with the syft CLI, a path to an existing SBOM file, or "none"`)
+		provenance = flag.Bool("provenance", false, "attach an in-toto SLSA v1.0 provenance attestation (DSSE-wrapped, signed with --sign if set) to pushed images and indexes, as an OCI 1.1 referrer artifact")
+		recipePath = flag.String("recipe", "", "path to a mkctr.yaml build recipe describing multi-stage layers and image config; takes precedence over --gopaths/--files/--ldflags/--gotags")
+		platforms  = flag.String("platforms", "", "comma-separated os/arch[/variant] platforms to build, restricting which manifests are taken from a multi-platform base (e.g. linux/amd64,linux/arm64,linux/riscv64); defaults to every platform the base publishes")
+		timestamp  = flag.String("timestamp", "", `timestamp to stamp onto layer tar entries and the image config's Created field: "zero" (default), "build" (the mkctr invocation time), "source" (each file's own mtime), or a specific RFC3339 timestamp or unix epoch; defaults to $SOURCE_DATE_EPOCH if set`)
+		jobs       = flag.Int("jobs", runtime.NumCPU(), "max number of platforms to build concurrently, for a multi-platform base")
 	)
 	flag.Parse()
 	if *tagArg == "" {
@@ -117,6 +153,9 @@ func main() {
 	if *baseImage == "" {
 		log.Fatal("baseImage must be set")
 	}
+	if *jobs < 1 {
+		log.Fatal("jobs must be at least 1")
+	}
 	switch *target {
 	case "", "flyio", "local":
 	default:
@@ -126,30 +165,56 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	paths, err := parseFiles(*gopaths)
+	paths, err := parseFileSpecs(*gopaths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	staticFiles, err := parseFileSpecs(*files)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wantPlatforms, err := parsePlatforms(*platforms)
 	if err != nil {
 		log.Fatal(err)
 	}
-	staticFiles, err := parseFiles(*files)
+	ts, err := parseTimestamp(*timestamp, time.Now())
 	if err != nil {
 		log.Fatal(err)
 	}
-	if len(paths) == 0 && len(staticFiles) == 0 {
-		log.Fatal("at least one of --files or --gopaths must be set")
+	var rec *recipe
+	if *recipePath != "" {
+		rec, err = loadRecipe(*recipePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if len(paths) == 0 && len(staticFiles) == 0 {
+		log.Fatal("at least one of --files, --gopaths or --recipe must be set")
 	}
 
 	bp := &buildParams{
-		baseImage:   *baseImage,
-		goPaths:     paths,
-		staticFiles: staticFiles,
-		imageRefs:   refs,
-		publish:     *push,
-		outPath:     *outPath,
-		ldflags:     *ldflagsArg,
-		gotags:      *gotags,
-		target:      *target,
-		verbose:     *verbose,
-		annotations: parseAnnotations(*annotations),
+		baseImage:     *baseImage,
+		goPaths:       paths,
+		staticFiles:   staticFiles,
+		imageRefs:     refs,
+		publish:       *push,
+		outPath:       *outPath,
+		daemon:        *daemonFlag,
+		ociLayoutPath: *ociLayout,
+		ldflags:       *ldflagsArg,
+		gotags:        *gotags,
+		target:        *target,
+		verbose:       *verbose,
+		annotations:   parseAnnotations(*annotations),
+		sign:          *sign,
+		cosignKey:     *cosignKey,
+		fulcioURL:     *fulcioURL,
+		rekorURL:      *rekorURL,
+		sbom:          *sbom,
+		provenance:    *provenance,
+		recipe:        rec,
+		platforms:     wantPlatforms,
+		timestamp:     ts,
+		jobs:          *jobs,
 	}
 
 	if err := fetchAndBuild(bp); err != nil {
@@ -157,18 +222,6 @@ func main() {
 	}
 }
 
-func fetchBaseImage(baseImage string, opts ...remote.Option) (*remote.Descriptor, error) {
-	baseRef, err := name.ParseReference(baseImage)
-	if err != nil {
-		return nil, err
-	}
-	desc, err := remote.Get(baseRef, opts...)
-	if err != nil {
-		return nil, err
-	}
-	return desc, nil
-}
-
 // canRunLocal reports whether the platform can run the binary locally, to be
 // used by the local target.
 func canRunLocal(p v1.Platform) bool {
@@ -196,13 +249,68 @@ func verifyPlatform(p v1.Platform, target string) error {
 		return fmt.Errorf("not required for target %q", target)
 	}
 	switch p.Architecture {
-	case "arm", "arm64", "amd64", "386":
+	case "arm", "arm64", "amd64", "386", "riscv64", "loong64", "s390x", "ppc64le", "mips64le":
 	default:
 		return fmt.Errorf("unsupported arch: %v", p.Architecture)
 	}
 	return nil
 }
 
+// parsePlatforms parses a comma-separated --platforms value into the
+// platforms it names, or returns nil if s is empty (meaning "every platform
+// the base publishes").
+func parsePlatforms(s string) ([]v1.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var out []v1.Platform
+	for _, ps := range strings.Split(s, ",") {
+		p, err := v1.ParsePlatform(ps)
+		if err != nil {
+			return nil, fmt.Errorf("parsing platform %q: %w", ps, err)
+		}
+		out = append(out, *p)
+	}
+	return out, nil
+}
+
+// platformWanted reports whether p should be built, given the platforms
+// requested via --platforms. An empty want means every platform is wanted.
+func platformWanted(want []v1.Platform, p v1.Platform) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		if p.Satisfies(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRequestedPlatformsPublished errors clearly if the base index doesn't
+// publish a manifest for one of the platforms requested via --platforms,
+// rather than silently building fewer platforms than asked for.
+func verifyRequestedPlatformsPublished(want []v1.Platform, manifests []v1.Descriptor) error {
+	var missing []string
+	for _, w := range want {
+		found := false
+		for _, m := range manifests {
+			if m.Platform != nil && m.Platform.Satisfies(w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, w.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("base image index does not publish requested platform(s): %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 func createOutDirectory(path string) error {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -272,35 +380,27 @@ func fetchAndBuild(bp *buildParams) error {
 			return err
 		}
 		logf := withPrefix(logf, fmt.Sprintf("%v/%v: ", p.OS, p.Architecture))
-		img, err := createImageForBase(bp, logf, baseImage, p)
+		baseDigest, err := baseImage.Digest()
+		if err != nil {
+			return err
+		}
+		img, art, err := createImageForBase(bp, logf, baseImage, p)
 		if err != nil {
 			return err
 		}
 
-		switch {
-		case bp.publish:
-			img = mutate.Annotations(img, bp.annotations).(v1.Image) // OCI annotations
-
-			for _, r := range bp.imageRefs {
-				if bp.target == "local" {
-					if err := loadLocalImage(logf, r, img); err != nil {
-						return err
-					}
-					continue
-				}
-				logf("pushing to %v", r)
-				if err := remote.Write(r, img, remoteOpts...); err != nil {
-					return err
-				}
+		img = mutate.Annotations(img, bp.annotations).(v1.Image) // OCI annotations
+		if bp.provenance {
+			d, err := img.Digest()
+			if err != nil {
+				return err
+			}
+			art.Provenance, err = generateProvenanceStatement(bp, p, art.Sources, bp.baseImage, baseDigest, d)
+			if err != nil {
+				return fmt.Errorf("generating provenance: %w", err)
 			}
-			return nil
-
-		case bp.outPath != "":
-			return writeImageToFile(img, bp.imageRefs[0], bp.outPath)
 		}
-		logf("not pushing or writing to file")
-
-		return nil
+		return writeToSinks(bp.sinks(remoteOpts), logf, bp.imageRefs, img, art)
 	case types.OCIImageIndex, types.DockerManifestList:
 		// baseRef is a multi-platform index, rest of the method handles this.
 	default:
@@ -315,88 +415,106 @@ func fetchAndBuild(bp *buildParams) error {
 	if err != nil {
 		return fmt.Errorf("failed to interpret base as index: %w", err)
 	}
-	var adds []mutate.IndexAddendum
-	// Try to build images for all supported platforms.
-	for _, id := range im.Manifests {
-		logf := withPrefix(logf, fmt.Sprintf("%v/%v: ", id.Platform.OS, id.Platform.Architecture))
+	if err := verifyRequestedPlatformsPublished(bp.platforms, im.Manifests); err != nil {
+		return err
+	}
+	// adds[i] corresponds to im.Manifests[i]; building happens concurrently
+	// (bounded by --jobs) but adds is filled in by index, so the resulting
+	// image index's manifest order never depends on which platform happens
+	// to finish compiling first.
+	adds := make([]*mutate.IndexAddendum, len(im.Manifests))
+	artifactsByIndex := make([]buildArtifacts, len(im.Manifests))
+	var eg errgroup.Group
+	eg.SetLimit(bp.jobs)
+	for i, id := range im.Manifests {
+		i, id := i, id
 		if id.Platform == nil {
 			return fmt.Errorf("unknown platform for image: %v", bp.baseImage)
 		}
+		logf := withPrefix(logf, fmt.Sprintf("%v/%v: ", id.Platform.OS, id.Platform.Architecture))
+		if !platformWanted(bp.platforms, *id.Platform) {
+			logf("skipping: not requested via --platforms")
+			continue
+		}
 		if err := verifyPlatform(*id.Platform, bp.target); err != nil {
 			logf("skipping: %v", err)
 			continue
 		}
-		logf("base digest: %v", id.Digest)
-		bi, err := baseIndex.Image(id.Digest)
-		if err != nil {
-			return err
-		}
-		logf("building")
-		img, err := createImageForBase(bp, logf, bi, *id.Platform)
-		if err != nil {
-			return err
-		}
+		eg.Go(func() error {
+			logf("base digest: %v", id.Digest)
+			bi, err := baseIndex.Image(id.Digest)
+			if err != nil {
+				return err
+			}
+			logf("building")
+			img, art, err := createImageForBase(bp, logf, bi, *id.Platform)
+			if err != nil {
+				return err
+			}
 
-		// Ensure that any provided OCI annotations are added to each OCI image manifest.
-		img = mutate.Annotations(img, bp.annotations).(v1.Image)
+			// Ensure that any provided OCI annotations are added to each OCI image manifest.
+			img = mutate.Annotations(img, bp.annotations).(v1.Image)
 
-		if args := flag.Args(); len(args) > 0 {
-			img, err = mutate.Config(img, v1.Config{
-				Cmd: args,
-			})
+			if args := flag.Args(); len(args) > 0 {
+				img, err = mutate.Config(img, v1.Config{
+					Cmd: args,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			d, err := img.Digest()
 			if err != nil {
 				return err
 			}
+			logf("new digest: %v", d)
+			if bp.provenance {
+				art.Provenance, err = generateProvenanceStatement(bp, *id.Platform, art.Sources, bp.baseImage, id.Digest, d)
+				if err != nil {
+					return fmt.Errorf("generating provenance: %w", err)
+				}
+			}
+			adds[i] = &mutate.IndexAddendum{
+				Add: img,
+				Descriptor: v1.Descriptor{
+					MediaType: id.MediaType,
+					URLs:      id.URLs,
+					Platform:  id.Platform,
+				},
+			}
+			artifactsByIndex[i] = art
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	var built []mutate.IndexAddendum
+	artifactsByDigest := map[v1.Hash]buildArtifacts{}
+	for i, add := range adds {
+		if add == nil {
+			continue
 		}
-		d, err := img.Digest()
+		built = append(built, *add)
+		d, err := add.Add.Digest()
 		if err != nil {
 			return err
 		}
-		logf("new digest: %v", d)
-		adds = append(adds, mutate.IndexAddendum{
-			Add: img,
-			Descriptor: v1.Descriptor{
-				MediaType: id.MediaType,
-				URLs:      id.URLs,
-				Platform:  id.Platform,
-			},
-		})
+		artifactsByDigest[d] = artifactsByIndex[i]
 	}
-	switch len(adds) {
+	switch len(built) {
 	case 0:
 		logf("no images")
 		return nil
 	case 1:
 		// Don't use a manifest for a single image.
-		img := adds[0].Add.(v1.Image)
+		img := built[0].Add.(v1.Image)
 		d, err := img.Digest()
 		if err != nil {
 			return err
 		}
 		logf("image digest: %v", d)
-
-		switch {
-		case bp.publish:
-			for _, r := range bp.imageRefs {
-				if bp.target == "local" {
-					if err := loadLocalImage(logf, r, img); err != nil {
-						return err
-					}
-					continue
-				}
-				logf("pushing to %v", r)
-				if err := remote.Write(r, img, remoteOpts...); err != nil {
-					return err
-				}
-			}
-			return nil
-
-		case bp.outPath != "":
-			return writeImageToFile(img, bp.imageRefs[0], bp.outPath)
-		}
-		logf("not pushing or writing to file")
-
-		return nil
+		return writeToSinks(bp.sinks(remoteOpts), logf, bp.imageRefs, img, artifactsByDigest[d])
 	}
 	if bp.target == "local" {
 		return fmt.Errorf("cannot build multi-platform images for local target")
@@ -404,7 +522,7 @@ func fetchAndBuild(bp *buildParams) error {
 	// Generate a new 'fat manifest' with all the platform images. If we are
 	// at this point the base was either a Dokcer manifest list or an OCI
 	// image index- make sure the new manifest of that type.
-	idx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, baseDesc.MediaType), adds...)
+	idx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, baseDesc.MediaType), built...)
 	d, err := idx.Digest()
 	if err != nil {
 		return err
@@ -414,32 +532,7 @@ func fetchAndBuild(bp *buildParams) error {
 	idx = mutate.Annotations(idx, bp.annotations).(v1.ImageIndex)
 
 	logf("index digest: %v", d)
-
-	switch {
-	case bp.publish:
-		for _, r := range bp.imageRefs {
-			logf("pushing to %v", r)
-			if err := remote.WriteIndex(r, idx, remoteOpts...); err != nil {
-				return err
-			}
-		}
-
-		return nil
-
-	case bp.outPath != "":
-		err := createOutDirectory(bp.outPath)
-		if err != nil {
-			return err
-		}
-		if _, err := layout.Write(bp.outPath, idx); err != nil {
-			return err
-		}
-
-		return nil
-	}
-	logf("not pushing or writing to file")
-
-	return nil
+	return writeIndexToSinks(bp.sinks(remoteOpts), logf, bp.imageRefs, idx, artifactsByDigest)
 }
 
 func goarm(platform v1.Platform) (string, error) {
@@ -456,62 +549,136 @@ func goarm(platform v1.Platform) (string, error) {
 	return string(v[1]), nil
 }
 
-func createImageForBase(bp *buildParams, logf logf, base v1.Image, platform v1.Platform) (v1.Image, error) {
-	tmpDir, err := os.MkdirTemp("", "mkctr")
-	if err != nil {
-		return nil, err
-	}
-	defer os.RemoveAll(tmpDir)
-
+// goEnv returns the os/arch-specific environment that compileGoBinary should
+// build with for platform.
+func goEnv(platform v1.Platform) ([]string, error) {
 	env := append(os.Environ(),
 		"CGO_ENABLED=0",
 		"GOOS="+platform.OS,
 		"GOARCH="+platform.Architecture,
 	)
-	if platform.Architecture == "arm" {
+	switch platform.Architecture {
+	case "arm":
 		v, err := goarm(platform)
 		if err != nil {
 			return nil, err
 		}
-		env = append(env, v)
+		env = append(env, "GOARM="+v)
+	case "amd64":
+		if platform.Variant != "" {
+			env = append(env, "GOAMD64="+platform.Variant)
+		}
+	case "mips", "mipsle", "mips64", "mips64le":
+		if platform.Variant != "" {
+			env = append(env, "GOMIPS="+platform.Variant)
+		}
 	}
+	return env, nil
+}
 
-	files := map[string]string{}
-	for src, dst := range bp.staticFiles {
-		files[src] = dst
+// layerMediaTypeForBase returns the layer media type matching base's own
+// manifest media type, so mixed Docker/OCI layers never end up in the same
+// image.
+func layerMediaTypeForBase(base v1.Image) (types.MediaType, error) {
+	mt, err := base.MediaType()
+	if err != nil {
+		return "", fmt.Errorf("error determining base image media type: %w", err)
+	}
+	switch mt {
+	case types.OCIManifestSchema1:
+		return types.OCILayer, nil
+	case types.DockerManifestSchema2:
+		return types.DockerLayer, nil
+	default:
+		return "", fmt.Errorf("unknown base image media type %v, accepted types are OCI image manifest v1 (%s) and Docker image manifest v2 (%s)", mt, types.OCIManifestSchema1, types.DockerManifestSchema2)
 	}
+}
 
-	// Compile all the goPaths
-	for gp, dst := range bp.goPaths {
+// createImageForBase builds a single layer of static files and compiled Go
+// binaries onto base, returning the resulting image along with its
+// --sbom=spdx document and the raw material (buildArtifacts.Sources) a
+// --provenance attestation needs, generated here because they depend on the
+// compiled binaries that still exist on disk under tmpDir. The provenance
+// statement itself is NOT generated here: its subject has to be the digest
+// of the image actually pushed, which isn't final until the caller has
+// applied --annotations on top of what's returned, so fetchAndBuild builds
+// it once that's done.
+func createImageForBase(bp *buildParams, logf logf, base v1.Image, platform v1.Platform) (v1.Image, buildArtifacts, error) {
+	if bp.recipe != nil {
+		return createImageFromRecipe(bp, logf, base, platform)
+	}
+	tmpDir, err := os.MkdirTemp("", "mkctr")
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	env, err := goEnv(platform)
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+
+	files := map[string]fileSpec{}
+	for src, spec := range bp.staticFiles {
+		files[src] = spec
+	}
+
+	// Compile all the goPaths, tracking the source revision of each (only
+	// if --provenance will actually use it) so --provenance can record
+	// exactly what was built.
+	var sources []buildSource
+	for gp, spec := range bp.goPaths {
 		logf("compiling %v", gp)
 		n, err := compileGoBinary(gp, tmpDir, env, bp.ldflags, bp.gotags, bp.verbose)
 		if err != nil {
-			return nil, err
+			return nil, buildArtifacts{}, err
 		}
 		logf("output %v -> %v", gp, n)
-		files[n] = dst
+		files[n] = spec
+		if bp.provenance {
+			sources = append(sources, buildSource{GoPath: gp, Revision: sourceRevision(n, gp)})
+		}
 	}
-	// Determine media type of the base image.
-	var layerMediaType types.MediaType
-	mt, err := base.MediaType()
+
+	var art buildArtifacts
+	art.Sources = sources
+	if bp.sbom == "spdx" {
+		art.SPDXSBOM, err = generateSPDXSBOM(platform.String(), files)
+		if err != nil {
+			return nil, buildArtifacts{}, fmt.Errorf("generating spdx sbom: %w", err)
+		}
+	}
+	layerMediaType, err := layerMediaTypeForBase(base)
 	if err != nil {
-		return nil, fmt.Errorf("error determining base image media type: %w", err)
+		return nil, buildArtifacts{}, err
 	}
-	switch mt {
-	case types.OCIManifestSchema1:
-		layerMediaType = types.OCILayer
-	case types.DockerManifestSchema2:
-		layerMediaType = types.DockerLayer
-	default:
-		return nil, fmt.Errorf("unknown base image media type %v, accepted types are OCI image manifest v1 (%s) and Docker image manifest v2 (%s)", mt, types.OCIManifestSchema1, types.DockerManifestSchema2)
+	layer, err := layerFromFilesCached(logf, files, layerMediaType, bp.timestamp)
+	if err != nil {
+		return nil, buildArtifacts{}, err
 	}
-	layer, err := layerFromFiles(logf, files, layerMediaType)
+	img, err := mutate.AppendLayers(base, layer)
 	if err != nil {
-		return nil, err
+		return nil, buildArtifacts{}, err
 	}
-	return mutate.AppendLayers(base, layer)
+	if !bp.timestamp.isZero() {
+		created, err := bp.timestamp.forImage(files)
+		if err != nil {
+			return nil, buildArtifacts{}, err
+		}
+		img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+		if err != nil {
+			return nil, buildArtifacts{}, err
+		}
+	}
+	return img, art, nil
 }
 
+// compileGoBinary builds the package at what with `go build`, returning the
+// path to the resulting binary under where. Results are cached on disk,
+// keyed by everything that can affect the output (gopath, the source of
+// gopath and every local package it imports, resolved module versions,
+// build environment, ldflags/gotags, go version); a cache hit copies the
+// previous binary instead of re-running `go build`.
 func compileGoBinary(what, where string, env []string, ldflags, gotags string, verbose bool) (string, error) {
 	f, err := os.CreateTemp(where, "out")
 	if err != nil {
@@ -521,6 +688,14 @@ func compileGoBinary(what, where string, env []string, ldflags, gotags string, v
 	if err := f.Close(); err != nil {
 		return "", err
 	}
+
+	key, keyErr := goBuildCacheKey(what, env, ldflags, gotags)
+	if keyErr == nil {
+		if cached, err := binaryCachePath(key); err == nil && copyFile(cached, out) == nil {
+			return out, nil
+		}
+	}
+
 	args := []string{
 		"build",
 		"-trimpath",
@@ -545,47 +720,87 @@ func compileGoBinary(what, where string, env []string, ldflags, gotags string, v
 	if err := cmd.Run(); err != nil {
 		return "", err
 	}
+	if keyErr == nil {
+		if cached, err := binaryCachePath(key); err == nil {
+			copyFile(out, cached) // best-effort; a cache write failure shouldn't fail the build
+		}
+	}
 	return out, nil
 }
 
-func layerFromFiles(logf logf, files map[string]string, layerMediaType types.MediaType) (v1.Layer, error) {
-	buf := bytes.NewBuffer(nil)
-	tw := tar.NewWriter(buf)
-	defer tw.Close()
+// tarEntry is a single file or directory to be written to a layer tarball,
+// resolved from the fileSpec DSL (and, for directories, implied by the
+// destination paths of the files within them).
+type tarEntry struct {
+	name  string // path inside the tarball
+	isDir bool
+	src   string // path on disk; unset for implied directories
+	spec  fileSpec
+}
 
-	dirs := make(map[string]bool)
-	writeDir := func(dir string) error {
-		if dirs[dir] {
-			return nil
-		}
-		logf("creating dir %v", dir)
-		if err := tw.WriteHeader(&tar.Header{
-			Name:     dir,
-			Typeflag: tar.TypeDir,
-			Mode:     0555,
-			// Set time to 0 to make the images reproducible.
-			ModTime: time.Time{},
-		}); err != nil {
-			return err
+// layerFromFiles builds a single reproducible layer containing files, at the
+// given destinations, permissions and ownership. Tar entries are written in
+// sorted order and with a fixed format so that two invocations against the
+// same inputs and the same tsr produce a byte-identical (and so
+// digest-identical) layer, except in timestampSource mode where entries
+// carry their own on-disk mtimes.
+func layerFromFiles(logf logf, files map[string]fileSpec, layerMediaType types.MediaType, tsr *timestampResolver) (v1.Layer, error) {
+	dirs := map[string]fileSpec{}
+	entries := map[string]tarEntry{}
+	addDir := func(dir string, spec fileSpec) {
+		if _, ok := dirs[dir]; !ok {
+			dirs[dir] = spec
 		}
-		dirs[dir] = true
-		return nil
 	}
-	for src, dst := range files {
+	for src, spec := range files {
 		err := filepath.WalkDir(src, func(srcWalk string, d fs.DirEntry, err error) error {
-			path := strings.TrimPrefix(srcWalk, src)
-			dstWalk := filepath.Join(dst, path)
-			writeDir(filepath.Dir(dstWalk))
+			if err != nil {
+				return err
+			}
+			rel := strings.TrimPrefix(srcWalk, src)
+			dstWalk := filepath.Join(spec.dst, rel)
+			addDir(filepath.Dir(dstWalk), fileSpec{mode: defaultFileMode})
 			if d.IsDir() {
-				return writeDir(dstWalk)
+				addDir(dstWalk, spec)
+				return nil
 			}
-			logf("copying %v -> %v", srcWalk, dstWalk)
-			return tarFile(tw, srcWalk, dstWalk)
+			entries[dstWalk] = tarEntry{name: dstWalk, src: srcWalk, spec: spec}
+			return nil
 		})
 		if err != nil {
 			return nil, err
 		}
 	}
+	for dir, spec := range dirs {
+		entries[dir] = tarEntry{name: dir, isDir: true, spec: spec}
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	defer tw.Close()
+	for _, name := range names {
+		e := entries[name]
+		if e.isDir {
+			logf("creating dir %v", e.name)
+			dirTime, err := tsr.forEntry(e.src)
+			if err != nil {
+				return nil, err
+			}
+			if err := tw.WriteHeader(tarHeader(e.name, tar.TypeDir, 0, e.spec, dirTime)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		logf("copying %v -> %v", e.src, e.name)
+		if err := tarFile(tw, e.src, e.name, e.spec, tsr); err != nil {
+			return nil, err
+		}
+	}
 	if err := tw.Close(); err != nil {
 		return nil, err
 	}
@@ -604,7 +819,23 @@ func layerFromFiles(logf logf, files map[string]string, layerMediaType types.Med
 	}, tarball.WithCompressedCaching, tarball.WithMediaType(layerMediaType))
 }
 
-func tarFile(tw *tar.Writer, src, dst string) error {
+// tarHeader builds a tar.Header for a reproducible layer entry. Format is
+// always PAX, with no volatile extended records (atime/ctime, uname/gname),
+// so that the same inputs always serialize to the same bytes.
+func tarHeader(name string, typeflag byte, size int64, spec fileSpec, ts time.Time) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Size:     size,
+		Typeflag: typeflag,
+		Mode:     spec.mode,
+		Uid:      spec.uid,
+		Gid:      spec.gid,
+		ModTime:  ts,
+		Format:   tar.FormatPAX,
+	}
+}
+
+func tarFile(tw *tar.Writer, src, dst string, spec fileSpec, tsr *timestampResolver) error {
 	file, err := os.Open(src)
 	if err != nil {
 		return err
@@ -614,14 +845,11 @@ func tarFile(tw *tar.Writer, src, dst string) error {
 	if err != nil {
 		return err
 	}
-	if err := tw.WriteHeader(&tar.Header{
-		Name:     dst,
-		Size:     stat.Size(),
-		Typeflag: tar.TypeReg,
-		Mode:     0555,
-		// Set time to 0 to make the images reproducible.
-		ModTime: time.Time{},
-	}); err != nil {
+	ts, err := tsr.forEntry(src)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(tarHeader(dst, tar.TypeReg, stat.Size(), spec, ts)); err != nil {
 		return err
 	}
 	if _, err := io.Copy(tw, file); err != nil {
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	got, err := parsePlatforms("linux/amd64,linux/arm64,linux/arm/v7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d platforms, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Equals(want[i]) {
+			t.Errorf("platform %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got, err := parsePlatforms(""); err != nil || got != nil {
+		t.Errorf("parsePlatforms(\"\") = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestPlatformWanted(t *testing.T) {
+	riscv64 := v1.Platform{OS: "linux", Architecture: "riscv64"}
+	if !platformWanted(nil, riscv64) {
+		t.Error("platformWanted(nil, riscv64) = false, want true")
+	}
+	want := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "riscv64"}}
+	if !platformWanted(want, riscv64) {
+		t.Error("riscv64 should be wanted")
+	}
+	if platformWanted(want, v1.Platform{OS: "linux", Architecture: "s390x"}) {
+		t.Error("s390x should not be wanted")
+	}
+}
+
+func TestVerifyRequestedPlatformsPublished(t *testing.T) {
+	manifests := []v1.Descriptor{
+		{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	}
+	if err := verifyRequestedPlatformsPublished([]v1.Platform{{OS: "linux", Architecture: "amd64"}}, manifests); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := verifyRequestedPlatformsPublished([]v1.Platform{{OS: "linux", Architecture: "riscv64"}}, manifests); err == nil {
+		t.Error("expected error for a platform the base doesn't publish")
+	}
+}
+
+func TestGoEnvNewArches(t *testing.T) {
+	env, err := goEnv(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsEnv(env, "GOARM=7") {
+		t.Errorf("expected GOARM=7 in %v", env)
+	}
+
+	env, err = goEnv(v1.Platform{OS: "linux", Architecture: "riscv64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsEnv(env, "GOARCH=riscv64") {
+		t.Errorf("expected GOARCH=riscv64 in %v", env)
+	}
+}
+
+func containsEnv(env []string, want string) bool {
+	for _, e := range env {
+		if e == want {
+			return true
+		}
+	}
+	return false
+}
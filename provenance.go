@@ -0,0 +1,324 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types for the provenance referrer mkctr pushes: the DSSE envelope
+// itself is the blob, and its artifactType (the OCI 1.1 referrer's config
+// media type) identifies the in-toto statement it carries, per the
+// conventions cosign/sigstore use for attestations.
+const (
+	dsseEnvelopeMediaType types.MediaType = "application/vnd.dsse.envelope.v1+json"
+	inTotoArtifactType    types.MediaType = "application/vnd.in-toto+json"
+)
+
+// in-toto/SLSA identifiers for the statement mkctr generates, per
+// https://github.com/in-toto/attestation/blob/main/spec/v1/statement.md and
+// https://slsa.dev/provenance/v1.
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaPredicateType   = "https://slsa.dev/provenance/v1"
+	slsaBuildType       = "https://github.com/tailscale/mkctr/buildtype/v1"
+)
+
+// buildSource records where a compiled Go binary baked into the image came
+// from: its gopath, and the git commit it was built at (best-effort; see
+// sourceRevision).
+type buildSource struct {
+	GoPath   string
+	Revision string
+}
+
+// inTotoStatement is the subset of the in-toto Statement envelope mkctr
+// emits, wrapping a SLSA v1.0 provenance predicate.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// slsaProvenance is the subset of the SLSA v1.0 provenance predicate mkctr
+// fills in: enough to answer what was built, from what source, on top of
+// what base, with what flags. mkctr doesn't claim provenance properties
+// (hermeticity, a signed builder identity) it can't actually back up.
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   slsaExternalParameters `json:"externalParameters"`
+	ResolvedDependencies []inTotoSubject        `json:"resolvedDependencies,omitempty"`
+}
+
+type slsaExternalParameters struct {
+	Platform string `json:"platform"`
+	LDFlags  string `json:"ldflags,omitempty"`
+	GoTags   string `json:"gotags,omitempty"`
+}
+
+type slsaRunDetails struct {
+	Builder slsaBuilder `json:"builder"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+// mkctrVersion returns the version of the running mkctr binary, as recorded
+// by the Go toolchain's build-info stamping, for the provenance predicate's
+// builder identity. It's "(unknown)" when mkctr itself wasn't built as a
+// versioned module (e.g. `go run .` from a non-module checkout).
+func mkctrVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(unknown)"
+	}
+	return info.Main.Version
+}
+
+// sourceRevision reports the git commit that binaryPath (compiled from
+// gopath) was built from: the VCS revision the Go toolchain stamps into a
+// binary automatically when built inside a clean git checkout, or else
+// `git rev-parse HEAD` run in gopath directly. Best-effort: a provenance
+// attestation records what mkctr observed, not a build input, so a
+// revision mkctr couldn't determine comes back as "" rather than failing
+// the build.
+func sourceRevision(binaryPath, gopath string) string {
+	if info, err := buildinfo.ReadFile(binaryPath); err == nil {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	out, err := exec.Command("git", "-C", gopath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// generateProvenanceStatement builds an in-toto Statement wrapping a SLSA
+// v1.0 provenance predicate for the image at subjectDigest: the base image
+// it was built on (baseRef@baseDigest), the sources compiled into it, and
+// the build environment (platform, ldflags, gotags). It's marshaled here,
+// rather than left as a Go value, so the caller can carry it around in
+// buildArtifacts as the same kind of opaque []byte as the SPDX SBOM it sits
+// alongside.
+//
+// Notably, this does NOT record the full process environment goEnv builds
+// for `go build` (bp isn't even in a position to see it before goEnv
+// prepends os.Environ()): that's inherited from whatever invoked mkctr and
+// may carry credentials that have no business in a signed, published
+// attestation. Only the build knobs mkctr itself controls are recorded.
+func generateProvenanceStatement(bp *buildParams, platform v1.Platform, sources []buildSource, baseRef string, baseDigest v1.Hash, subjectDigest v1.Hash) ([]byte, error) {
+	var name string
+	if len(bp.imageRefs) > 0 {
+		name = bp.imageRefs[0].Context().Name()
+	}
+	deps := []inTotoSubject{{
+		Name:   baseRef,
+		Digest: map[string]string{baseDigest.Algorithm: baseDigest.Hex},
+	}}
+	for _, src := range sources {
+		digest := map[string]string{}
+		if src.Revision != "" {
+			digest["gitCommit"] = src.Revision
+		}
+		deps = append(deps, inTotoSubject{Name: src.GoPath, Digest: digest})
+	}
+	stmt := inTotoStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaPredicateType,
+		Subject: []inTotoSubject{{
+			Name:   name,
+			Digest: map[string]string{subjectDigest.Algorithm: subjectDigest.Hex},
+		}},
+		Predicate: slsaProvenance{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType: slsaBuildType,
+				ExternalParameters: slsaExternalParameters{
+					Platform: platform.String(),
+					LDFlags:  bp.ldflags,
+					GoTags:   bp.gotags,
+				},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: slsaRunDetails{
+				Builder: slsaBuilder{ID: "https://github.com/tailscale/mkctr@" + mkctrVersion()},
+			},
+		},
+	}
+	return json.MarshalIndent(stmt, "", "  ")
+}
+
+// dsseEnvelope is the DSSE (Dead Simple Signing Envelope) mkctr wraps the
+// in-toto provenance statement in before pushing it, per
+// https://github.com/secure-systems-lab/dsse/blob/master/envelope.md.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"` // base64
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	Sig string `json:"sig"` // base64
+}
+
+// dssePAE computes the DSSE Pre-Authentication Encoding of payload: the
+// exact bytes a DSSE signature is made over, binding the payload and its
+// declared type into one unambiguous message so a signature can't be
+// replayed against the same bytes under a different payloadType.
+func dssePAE(payloadType string, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("DSSEv1 ")
+	buf.WriteString(strconv.Itoa(len(payloadType)))
+	buf.WriteByte(' ')
+	buf.WriteString(payloadType)
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(len(payload)))
+	buf.WriteByte(' ')
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// signProvenance wraps statement in a DSSE envelope and signs it per
+// bp.sign, mirroring signDigest/signDigestKeyless: --sign=key signs with
+// the long-lived --cosign-key, --sign=keyless with an ephemeral key and a
+// Fulcio certificate recorded in Rekor. With --sign unset or "none" the
+// envelope comes back unsigned — a valid DSSE envelope with no
+// Signatures — since --provenance doesn't require --sign: an unsigned
+// attestation is exactly as trustworthy as any other artifact a pusher
+// could attach to the registry. The returned annotations (nil if
+// unsigned) are attached to the pushed referrer manifest alongside the
+// envelope, the same way signDigest/signDigestKeyless embed the signing
+// certificate on an image signature.
+func signProvenance(bp *buildParams, statement []byte) (dsseEnvelope, map[string]string, error) {
+	envelope := dsseEnvelope{
+		PayloadType: string(inTotoArtifactType),
+		Payload:     base64.StdEncoding.EncodeToString(statement),
+	}
+	switch bp.sign {
+	case "", "none":
+		return envelope, nil, nil
+	case "key":
+		key, err := loadCosignKey(bp.cosignKey)
+		if err != nil {
+			return envelope, nil, err
+		}
+		pubPEM, err := pemEncodeECDSAPublicKey(&key.PublicKey)
+		if err != nil {
+			return envelope, nil, err
+		}
+		sig, err := signDSSE(key, envelope)
+		if err != nil {
+			return envelope, nil, err
+		}
+		envelope.Signatures = []dsseSignature{{Sig: base64.StdEncoding.EncodeToString(sig)}}
+		return envelope, map[string]string{"dev.sigstore.cosign/certificate": string(pubPEM)}, nil
+	case "keyless":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return envelope, nil, fmt.Errorf("generating ephemeral signing key: %w", err)
+		}
+		idToken, err := getAmbientOIDCToken()
+		if err != nil {
+			return envelope, nil, fmt.Errorf("keyless signing: %w", err)
+		}
+		certPEM, err := requestFulcioCert(bp.fulcioURL, idToken, key)
+		if err != nil {
+			return envelope, nil, fmt.Errorf("keyless signing: %w", err)
+		}
+		sig, err := signDSSE(key, envelope)
+		if err != nil {
+			return envelope, nil, err
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return envelope, nil, err
+		}
+		set, err := uploadToRekor(bp.rekorURL, dssePAE(envelope.PayloadType, payload), sig, certPEM)
+		if err != nil {
+			return envelope, nil, fmt.Errorf("keyless signing: %w", err)
+		}
+		envelope.Signatures = []dsseSignature{{Sig: base64.StdEncoding.EncodeToString(sig)}}
+		return envelope, map[string]string{
+			"dev.sigstore.cosign/certificate": string(certPEM),
+			"dev.sigstore.cosign/bundle":      base64.StdEncoding.EncodeToString(set),
+		}, nil
+	default:
+		return envelope, nil, fmt.Errorf("unsupported --sign value %q", bp.sign)
+	}
+}
+
+// signDSSE signs envelope's payload with key, over its DSSE
+// Pre-Authentication Encoding rather than the raw payload bytes.
+func signDSSE(key *ecdsa.PrivateKey, envelope dsseEnvelope) ([]byte, error) {
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(dssePAE(envelope.PayloadType, payload))
+	return ecdsa.SignASN1(rand.Reader, key, sum[:])
+}
+
+// pushProvenanceReferrer pushes envelope to repo as an OCI 1.1 referrer
+// artifact: a manifest whose subject points at subject and whose
+// artifactType is the in-toto media type, the same way pushSPDXReferrer
+// attaches an SBOM.
+func pushProvenanceReferrer(logf logf, repo name.Repository, subject v1.Descriptor, envelope dsseEnvelope, annotations map[string]string, opts []remote.Option) error {
+	raw, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(raw, dsseEnvelopeMediaType),
+		Annotations: annotations,
+	})
+	if err != nil {
+		return err
+	}
+	img = mutate.ConfigMediaType(img, inTotoArtifactType)
+	img = mutate.Subject(img, subject).(v1.Image)
+
+	d, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	ref := repo.Digest(d.String())
+	logf("pushing provenance referrer for %v to %v", subject.Digest, ref)
+	return remote.Write(ref, img, opts...)
+}
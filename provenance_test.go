@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// TestDssePAE verifies dssePAE against the worked example from the DSSE
+// spec itself: https://github.com/secure-systems-lab/dsse/blob/master/envelope.md.
+func TestDssePAE(t *testing.T) {
+	got := dssePAE("http://example.com/HelloWorld", []byte("hello world"))
+	want := "DSSEv1 29 http://example.com/HelloWorld 11 hello world"
+	if string(got) != want {
+		t.Fatalf("dssePAE = %q, want %q", got, want)
+	}
+}
+
+// TestSignDSSE verifies that signDSSE produces a signature that verifies
+// against the pre-authentication encoding of the envelope's payload and
+// payloadType, not the raw payload bytes.
+func TestSignDSSE(t *testing.T) {
+	key := mustGenerateECDSAKey(t)
+	envelope := dsseEnvelope{
+		PayloadType: inTotoStatementType,
+		Payload:     base64.StdEncoding.EncodeToString([]byte(`{"hello":"world"}`)),
+	}
+	sig, err := signDSSE(key, envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(dssePAE(envelope.PayloadType, []byte(`{"hello":"world"}`)))
+	if !ecdsa.VerifyASN1(&key.PublicKey, sum[:], sig) {
+		t.Fatal("signature does not verify against the envelope's pre-authentication encoding")
+	}
+}
+
+// TestGenerateProvenanceStatement verifies that generateProvenanceStatement
+// records the base image, every compiled source, and the build parameters
+// it was given in the resulting in-toto statement.
+func TestGenerateProvenanceStatement(t *testing.T) {
+	tag, err := name.NewTag("example.com/repo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := &buildParams{
+		imageRefs: []name.Tag{tag},
+		ldflags:   "-X main.version=v1",
+		gotags:    "netgo",
+	}
+	platform := v1.Platform{OS: "linux", Architecture: "amd64"}
+	sources := []buildSource{
+		{GoPath: "./cmd/foo", Revision: "deadbeef"},
+	}
+	baseDigest := v1.Hash{Algorithm: "sha256", Hex: "1111111111111111111111111111111111111111111111111111111111aaaa"}
+	subjectDigest := v1.Hash{Algorithm: "sha256", Hex: "2222222222222222222222222222222222222222222222222222222222bbbb"}
+
+	raw, err := generateProvenanceStatement(bp, platform, sources, "example.com/base", baseDigest, subjectDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stmt inTotoStatement
+	if err := json.Unmarshal(raw, &stmt); err != nil {
+		t.Fatalf("generated statement isn't valid JSON: %v", err)
+	}
+	if stmt.Type != inTotoStatementType {
+		t.Fatalf("_type = %q, want %q", stmt.Type, inTotoStatementType)
+	}
+	if stmt.PredicateType != slsaPredicateType {
+		t.Fatalf("predicateType = %q, want %q", stmt.PredicateType, slsaPredicateType)
+	}
+	if len(stmt.Subject) != 1 || stmt.Subject[0].Digest["sha256"] != subjectDigest.Hex {
+		t.Fatalf("subject = %+v, want digest %q", stmt.Subject, subjectDigest.Hex)
+	}
+	if stmt.Predicate.BuildDefinition.ExternalParameters.LDFlags != bp.ldflags {
+		t.Fatalf("ldflags = %q, want %q", stmt.Predicate.BuildDefinition.ExternalParameters.LDFlags, bp.ldflags)
+	}
+	deps := stmt.Predicate.BuildDefinition.ResolvedDependencies
+	if len(deps) != 2 {
+		t.Fatalf("got %d resolved dependencies, want 2 (base image + 1 source)", len(deps))
+	}
+	if deps[0].Name != "example.com/base" || deps[0].Digest["sha256"] != baseDigest.Hex {
+		t.Fatalf("deps[0] = %+v, want base image example.com/base@%s", deps[0], baseDigest.Hex)
+	}
+	if deps[1].Name != "./cmd/foo" || deps[1].Digest["gitCommit"] != "deadbeef" {
+		t.Fatalf("deps[1] = %+v, want ./cmd/foo@deadbeef", deps[1])
+	}
+}
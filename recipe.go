@@ -0,0 +1,329 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"gopkg.in/yaml.v3"
+)
+
+// recipe is the parsed form of an mkctr.yaml build recipe: a
+// Dockerfile-like, declarative alternative to the flat --gopaths/--files/
+// --ldflags flags. It describes one or more build stages, each contributing
+// an ordered layer, plus the resulting image's runtime config.
+type recipe struct {
+	Stages []recipeStage `yaml:"stages"`
+
+	Entrypoint  []string           `yaml:"entrypoint"`
+	Cmd         []string           `yaml:"cmd"`
+	Env         map[string]string  `yaml:"env"`
+	WorkDir     string             `yaml:"workdir"`
+	User        string             `yaml:"user"`
+	Expose      []string           `yaml:"expose"`
+	Labels      map[string]string  `yaml:"labels"`
+	Healthcheck *recipeHealthcheck `yaml:"healthcheck"`
+}
+
+// recipeStage is one COPY-like build step. GoPaths are compiled with `go
+// build` as in the flag-driven build; Files are copied as-is. Both map a
+// source to a "dst[:mode[:uid[:gid]]]" spec, using the same DSL as --files.
+//
+// A Files source of the form "stage://<name>/<dst>" reuses the output a
+// previous stage placed at <dst>, instead of reading from disk, mirroring
+// Docker's `COPY --from=<name>`.
+type recipeStage struct {
+	Name    string            `yaml:"name"`
+	GoPaths map[string]string `yaml:"gopaths"`
+	Files   map[string]string `yaml:"files"`
+	Env     []string          `yaml:"env"` // additional env vars for this stage's `go build`
+}
+
+type recipeHealthcheck struct {
+	Test        []string `yaml:"test"`
+	Interval    string   `yaml:"interval"`
+	Timeout     string   `yaml:"timeout"`
+	StartPeriod string   `yaml:"startPeriod"`
+	Retries     int      `yaml:"retries"`
+}
+
+// loadRecipe reads and parses a build recipe from path.
+func loadRecipe(path string) (*recipe, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading recipe %q: %w", path, err)
+	}
+	var r recipe
+	if err := yaml.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("parsing recipe %q: %w", path, err)
+	}
+	if len(r.Stages) == 0 {
+		return nil, fmt.Errorf("recipe %q has no stages", path)
+	}
+	return &r, nil
+}
+
+// createImageFromRecipe builds base up one layer per recipe stage, then
+// applies the recipe's image config. A stage whose output is only ever read
+// by a later stage's "stage://" reference (a "builder" stage, in the
+// Dockerfile sense) contributes no layer of its own: only the bytes its
+// consumer re-places at its own destination end up in the image. It returns
+// the resulting image along with its --sbom=spdx document and the raw
+// material (buildArtifacts.Sources) a --provenance attestation needs,
+// generated here while every stage's compiled binaries still exist on disk
+// under tmpDir. The provenance statement itself is built later by
+// fetchAndBuild, once --annotations has been applied on top of the image
+// this returns, so its subject digest matches what's actually pushed.
+func createImageFromRecipe(bp *buildParams, logf logf, base v1.Image, platform v1.Platform) (v1.Image, buildArtifacts, error) {
+	rec := bp.recipe
+	tmpDir, err := os.MkdirTemp("", "mkctr")
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	baseEnv, err := goEnv(platform)
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+	layerMediaType, err := layerMediaTypeForBase(base)
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+
+	// produced[stage][dst] is the on-disk path of whatever that stage put
+	// at container path dst, so later stages can reuse it via stage://.
+	produced := map[string]map[string]string{}
+	// latestByDst tracks, for each container path, the src on disk that last
+	// wrote it: a later stage overwriting an earlier stage's dst should
+	// supersede it in allFiles below, not add a second entry alongside it.
+	latestByDst := map[string]string{}
+	specByDst := map[string]fileSpec{}
+
+	// forwarded marks every (stage, dst) that some later stage's stage://
+	// reference reads from: that stage's own copy of the bytes never needs
+	// to ship, since whichever stage forwards it re-places the same bytes at
+	// its own destination (and, transitively, its copy is excluded in turn
+	// if something forwards it again). Without this, a "builder" stage whose
+	// output is only ever consumed via stage:// still ends up as a layer of
+	// its own in the shipped image.
+	forwarded, err := forwardedStageFiles(rec.Stages)
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+
+	// sources tracks the source revision of every gopath compiled across all
+	// stages, so --provenance can record exactly what was built, including
+	// gopaths compiled by a stage whose output is only ever forwarded.
+	var sources []buildSource
+
+	img := base
+	for _, stage := range rec.Stages {
+		if stage.Name == "" {
+			return nil, buildArtifacts{}, fmt.Errorf("recipe stage missing a name")
+		}
+		stageLogf := withPrefix(logf, fmt.Sprintf("[%s] ", stage.Name))
+		stageEnv := append(append([]string{}, baseEnv...), stage.Env...)
+		stageFiles := map[string]fileSpec{}
+		stageOut := map[string]string{}
+
+		for gp, specStr := range stage.GoPaths {
+			spec, err := parseFileSpec(specStr)
+			if err != nil {
+				return nil, buildArtifacts{}, fmt.Errorf("stage %q gopath %q: %w", stage.Name, gp, err)
+			}
+			stageLogf("compiling %v", gp)
+			n, err := compileGoBinary(gp, tmpDir, stageEnv, bp.ldflags, bp.gotags, bp.verbose)
+			if err != nil {
+				return nil, buildArtifacts{}, err
+			}
+			stageLogf("output %v -> %v", gp, n)
+			stageFiles[n] = spec
+			stageOut[spec.dst] = n
+			if bp.provenance {
+				sources = append(sources, buildSource{GoPath: gp, Revision: sourceRevision(n, gp)})
+			}
+		}
+		for src, specStr := range stage.Files {
+			spec, err := parseFileSpec(specStr)
+			if err != nil {
+				return nil, buildArtifacts{}, fmt.Errorf("stage %q file %q: %w", stage.Name, src, err)
+			}
+			resolved, err := resolveStageSrc(produced, src)
+			if err != nil {
+				return nil, buildArtifacts{}, fmt.Errorf("stage %q file %q: %w", stage.Name, src, err)
+			}
+			stageFiles[resolved] = spec
+			stageOut[spec.dst] = resolved
+		}
+		produced[stage.Name] = stageOut
+
+		// shipped is stageFiles minus whatever a later stage forwards from
+		// here: only these actually become part of the image.
+		shipped := map[string]fileSpec{}
+		for src, spec := range stageFiles {
+			if forwarded[stage.Name][spec.dst] {
+				continue
+			}
+			shipped[src] = spec
+			latestByDst[spec.dst] = src
+			specByDst[spec.dst] = spec
+		}
+
+		if len(shipped) == 0 {
+			continue
+		}
+		layer, err := layerFromFilesCached(stageLogf, shipped, layerMediaType, bp.timestamp)
+		if err != nil {
+			return nil, buildArtifacts{}, err
+		}
+		if img, err = mutate.AppendLayers(img, layer); err != nil {
+			return nil, buildArtifacts{}, err
+		}
+	}
+
+	// allFiles is the final set of files actually present in the built
+	// image, one entry per container path: dedupe away any earlier stage's
+	// src that a later stage's dst overwrote, so timestamp derivation and
+	// the generated SBOM don't describe a shadowed file.
+	allFiles := make(map[string]fileSpec, len(latestByDst))
+	for dst, src := range latestByDst {
+		allFiles[src] = specByDst[dst]
+	}
+
+	cfg, err := recipeConfig(rec)
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+	img, err = mutate.Config(img, cfg)
+	if err != nil {
+		return nil, buildArtifacts{}, err
+	}
+	if !bp.timestamp.isZero() {
+		created, err := bp.timestamp.forImage(allFiles)
+		if err != nil {
+			return nil, buildArtifacts{}, err
+		}
+		if img, err = mutate.CreatedAt(img, v1.Time{Time: created}); err != nil {
+			return nil, buildArtifacts{}, err
+		}
+	}
+	art := buildArtifacts{Sources: sources}
+	if bp.sbom == "spdx" {
+		art.SPDXSBOM, err = generateSPDXSBOM(platform.String(), allFiles)
+		if err != nil {
+			return nil, buildArtifacts{}, fmt.Errorf("generating spdx sbom: %w", err)
+		}
+	}
+	return img, art, nil
+}
+
+// forwardedStageFiles scans every stage's Files map for "stage://<name>/<dst>"
+// sources, and returns, per producing stage name, the set of dsts some later
+// stage reads that way.
+func forwardedStageFiles(stages []recipeStage) (map[string]map[string]bool, error) {
+	forwarded := map[string]map[string]bool{}
+	for _, stage := range stages {
+		for src := range stage.Files {
+			rest, ok := strings.CutPrefix(src, "stage://")
+			if !ok {
+				continue
+			}
+			name, dst, ok := strings.Cut(rest, "/")
+			if !ok {
+				return nil, fmt.Errorf("malformed stage reference %q, want stage://<name>/<dst>", src)
+			}
+			if forwarded[name] == nil {
+				forwarded[name] = map[string]bool{}
+			}
+			forwarded[name]["/"+dst] = true
+		}
+	}
+	return forwarded, nil
+}
+
+// resolveStageSrc turns a recipe Files source into a path on disk, resolving
+// "stage://<name>/<dst>" references against files already produced by
+// earlier stages.
+func resolveStageSrc(produced map[string]map[string]string, src string) (string, error) {
+	rest, ok := strings.CutPrefix(src, "stage://")
+	if !ok {
+		return src, nil
+	}
+	name, dst, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", fmt.Errorf("malformed stage reference %q, want stage://<name>/<dst>", src)
+	}
+	dst = "/" + dst
+	stageOut, ok := produced[name]
+	if !ok {
+		return "", fmt.Errorf("reference to unknown or not-yet-run stage %q", name)
+	}
+	path, ok := stageOut[dst]
+	if !ok {
+		return "", fmt.Errorf("stage %q never produced %q", name, dst)
+	}
+	return path, nil
+}
+
+// parseFileSpec parses a single "dst[:mode[:uid[:gid]]]" spec, the value
+// half of a recipe stage's gopaths/files map.
+func parseFileSpec(s string) (fileSpec, error) {
+	specs, err := parseFileSpecs("x:" + s)
+	if err != nil {
+		return fileSpec{}, err
+	}
+	return specs["x"], nil
+}
+
+// recipeConfig translates a recipe's top-level fields into a v1.Config.
+func recipeConfig(rec *recipe) (v1.Config, error) {
+	cfg := v1.Config{
+		Entrypoint: rec.Entrypoint,
+		Cmd:        rec.Cmd,
+		WorkingDir: rec.WorkDir,
+		User:       rec.User,
+		Labels:     rec.Labels,
+	}
+	for k, v := range rec.Env {
+		cfg.Env = append(cfg.Env, k+"="+v)
+	}
+	if len(rec.Expose) > 0 {
+		cfg.ExposedPorts = map[string]struct{}{}
+		for _, p := range rec.Expose {
+			cfg.ExposedPorts[p] = struct{}{}
+		}
+	}
+	if rec.Healthcheck != nil {
+		hc := &v1.HealthConfig{
+			Test:    rec.Healthcheck.Test,
+			Retries: rec.Healthcheck.Retries,
+		}
+		var err error
+		if hc.Interval, err = parseOptionalDuration(rec.Healthcheck.Interval); err != nil {
+			return cfg, fmt.Errorf("healthcheck.interval: %w", err)
+		}
+		if hc.Timeout, err = parseOptionalDuration(rec.Healthcheck.Timeout); err != nil {
+			return cfg, fmt.Errorf("healthcheck.timeout: %w", err)
+		}
+		if hc.StartPeriod, err = parseOptionalDuration(rec.Healthcheck.StartPeriod); err != nil {
+			return cfg, fmt.Errorf("healthcheck.startPeriod: %w", err)
+		}
+		cfg.Healthcheck = hc
+	}
+	return cfg, nil
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+)
+
+func TestLoadRecipe(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mkctr.yaml")
+	const doc = `
+entrypoint: ["/usr/bin/tailscaled"]
+workdir: /app
+expose: ["8080/tcp"]
+labels:
+  org.opencontainers.image.source: https://github.com/tailscale/tailscale
+healthcheck:
+  test: ["CMD", "/usr/bin/tailscaled", "status"]
+  interval: 30s
+  retries: 3
+stages:
+  - name: builder
+    gopaths:
+      ./cmd/tailscaled: /usr/bin/tailscaled
+  - name: runtime
+    files:
+      stage://builder/usr/bin/tailscaled: /usr/bin/tailscaled:0555
+`
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := loadRecipe(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Stages) != 2 {
+		t.Fatalf("got %d stages, want 2", len(rec.Stages))
+	}
+	if rec.Healthcheck == nil || rec.Healthcheck.Retries != 3 {
+		t.Fatalf("healthcheck not parsed: %+v", rec.Healthcheck)
+	}
+	cfg, err := recipeConfig(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Healthcheck.Interval.String() != "30s" {
+		t.Fatalf("got interval %v, want 30s", cfg.Healthcheck.Interval)
+	}
+}
+
+func TestResolveStageSrc(t *testing.T) {
+	produced := map[string]map[string]string{
+		"builder": {"/usr/bin/tailscaled": "/tmp/mkctr123/out"},
+	}
+	got, err := resolveStageSrc(produced, "stage://builder/usr/bin/tailscaled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/tmp/mkctr123/out"; got != want {
+		t.Fatalf("resolveStageSrc = %q, want %q", got, want)
+	}
+	if _, err := resolveStageSrc(produced, "stage://missing/usr/bin/tailscaled"); err == nil {
+		t.Fatal("expected error for unknown stage")
+	}
+}
+
+// TestCreateImageFromRecipeBuilderStageNotShipped verifies that a "builder"
+// stage whose output is only ever consumed via stage:// by a later stage
+// contributes no layer of its own: the shipped image should have exactly one
+// layer, containing only the runtime stage's output.
+func TestCreateImageFromRecipeBuilderStageNotShipped(t *testing.T) {
+	dir := t.TempDir()
+	builderSrc := filepath.Join(dir, "binary")
+	if err := os.WriteFile(builderSrc, []byte("binary contents\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recipe{
+		Stages: []recipeStage{
+			{
+				Name:  "builder",
+				Files: map[string]string{builderSrc: "/builder-only/out"},
+			},
+			{
+				Name:  "runtime",
+				Files: map[string]string{"stage://builder/builder-only/out": "/usr/bin/app:0555"},
+			},
+		},
+		Entrypoint: []string{"/usr/bin/app"},
+	}
+	bp := &buildParams{
+		recipe:    rec,
+		timestamp: &timestampResolver{mode: timestampZero},
+	}
+
+	img, _, err := createImageFromRecipe(bp, noopLogf, empty.Image, v1.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("got %d layers, want 1 (builder stage should not ship its own layer)", len(layers))
+	}
+
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	var gotPaths []string
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		gotPaths = append(gotPaths, hdr.Name)
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, []byte("binary contents\n")) {
+			t.Fatalf("file %q contents = %q, want %q", hdr.Name, buf, "binary contents\n")
+		}
+	}
+	if want := []string{"/usr/bin/app"}; !reflect.DeepEqual(gotPaths, want) {
+		t.Fatalf("layer contains files %v, want %v (builder-only path must not be shipped)", gotPaths, want)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultFileMode is the permission bits used for a file or directory whose
+// fileSpec doesn't specify one, matching the previous hardcoded behavior.
+const defaultFileMode = 0555
+
+// fileSpec describes where a file (or directory tree) should land in the
+// image, and what permissions and ownership it should carry there.
+type fileSpec struct {
+	dst  string
+	mode int64
+	uid  int
+	gid  int
+}
+
+// parseFileSpecs parses the --files/--gopaths DSL: a comma-separated list of
+// "src:dst[:mode[:uid[:gid]]]" entries. If s starts with "@", the rest is
+// instead a path to a JSON manifest of the same information; see
+// fileManifestEntry.
+func parseFileSpecs(s string) (map[string]fileSpec, error) {
+	ret := map[string]fileSpec{}
+	if len(s) == 0 {
+		return ret, nil
+	}
+	if rest, ok := strings.CutPrefix(s, "@"); ok {
+		return parseFileManifest(rest)
+	}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		fs := strings.Split(f, ":")
+		if len(fs) < 2 || len(fs) > 5 {
+			return nil, fmt.Errorf("unparseable file field %q", f)
+		}
+		spec := fileSpec{dst: fs[1], mode: defaultFileMode}
+		if len(fs) > 2 && fs[2] != "" {
+			mode, err := strconv.ParseInt(fs[2], 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unparseable mode in %q: %w", f, err)
+			}
+			spec.mode = mode
+		}
+		if len(fs) > 3 && fs[3] != "" {
+			uid, err := strconv.Atoi(fs[3])
+			if err != nil {
+				return nil, fmt.Errorf("unparseable uid in %q: %w", f, err)
+			}
+			spec.uid = uid
+		}
+		if len(fs) > 4 && fs[4] != "" {
+			gid, err := strconv.Atoi(fs[4])
+			if err != nil {
+				return nil, fmt.Errorf("unparseable gid in %q: %w", f, err)
+			}
+			spec.gid = gid
+		}
+		ret[fs[0]] = spec
+	}
+	return ret, nil
+}
+
+// fileManifestEntry is one entry of a JSON file manifest, an alternative to
+// the colon-separated DSL for large or generated file lists.
+type fileManifestEntry struct {
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	Mode int64  `json:"mode"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+}
+
+func parseFileManifest(path string) (map[string]fileSpec, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading file manifest %q: %w", path, err)
+	}
+	var entries []fileManifestEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("parsing file manifest %q: %w", path, err)
+	}
+	ret := map[string]fileSpec{}
+	for _, e := range entries {
+		mode := e.Mode
+		if mode == 0 {
+			mode = defaultFileMode
+		}
+		ret[e.Src] = fileSpec{dst: e.Dst, mode: mode, uid: e.UID, gid: e.GID}
+	}
+	return ret, nil
+}
+
+// timestampMode selects how a timestampResolver resolves the time stamped
+// onto layer tar entries and the image config's Created field.
+type timestampMode int
+
+const (
+	timestampZero   timestampMode = iota // the zero time (the previous hardcoded behavior)
+	timestampBuild                       // the mkctr invocation time
+	timestampSource                      // each file's own on-disk mtime; newest mtime for the image config
+	timestampFixed                       // a specific instant, from an RFC3339 literal or a unix epoch
+)
+
+// timestampResolver resolves the --timestamp flag into concrete times for
+// layerFromFiles/tarFile (forEntry) and for the image config's Created field
+// (forImage).
+type timestampResolver struct {
+	mode  timestampMode
+	fixed time.Time // valid for timestampBuild and timestampFixed
+}
+
+// parseTimestamp parses the --timestamp flag value: "zero" (the default),
+// "build" (the mkctr invocation time, passed in as now), "source" (use each
+// file's own mtime), or a specific instant as an RFC3339 timestamp or a unix
+// epoch (SOURCE_DATE_EPOCH style). An empty string falls back to
+// $SOURCE_DATE_EPOCH (https://reproducible-builds.org/docs/source-date-epoch/)
+// if set, and to "zero" otherwise.
+func parseTimestamp(s string, now time.Time) (*timestampResolver, error) {
+	switch s {
+	case "":
+		if v := os.Getenv("SOURCE_DATE_EPOCH"); v != "" {
+			return parseTimestamp(v, now)
+		}
+		return &timestampResolver{mode: timestampZero}, nil
+	case "zero":
+		return &timestampResolver{mode: timestampZero}, nil
+	case "build":
+		return &timestampResolver{mode: timestampBuild, fixed: now.UTC()}, nil
+	case "source":
+		return &timestampResolver{mode: timestampSource}, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return &timestampResolver{mode: timestampFixed, fixed: time.Unix(sec, 0).UTC()}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &timestampResolver{mode: timestampFixed, fixed: t.UTC()}, nil
+	}
+	return nil, fmt.Errorf("invalid --timestamp %q: want \"zero\", \"build\", \"source\", an RFC3339 timestamp, or a unix epoch", s)
+}
+
+// forEntry returns the tar ModTime for a layer entry sourced from src, the
+// empty string for synthetic directory entries with no file of their own on
+// disk.
+func (r *timestampResolver) forEntry(src string) (time.Time, error) {
+	if r.mode != timestampSource || src == "" {
+		return r.fixed, nil
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime().UTC(), nil
+}
+
+// forImage returns the time to stamp onto the image config's Created field,
+// given every file contributing to the build: in "source" mode, the newest
+// mtime found anywhere under any of files; otherwise, the resolver's fixed
+// time.
+func (r *timestampResolver) forImage(files map[string]fileSpec) (time.Time, error) {
+	if r.mode != timestampSource {
+		return r.fixed, nil
+	}
+	var newest time.Time
+	for src := range files {
+		err := filepath.WalkDir(src, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if t := info.ModTime(); t.After(newest) {
+				newest = t
+			}
+			return nil
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return newest.UTC(), nil
+}
+
+// isZero reports whether r resolves to the zero time unconditionally,
+// letting callers skip mutate.CreatedAt entirely as before.
+func (r *timestampResolver) isZero() bool {
+	return r.mode == timestampZero
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func noopLogf(string, ...interface{}) {}
+
+func TestParseFileSpecs(t *testing.T) {
+	got, err := parseFileSpecs("a:/b,c:/d:0644:1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]fileSpec{
+		"a": {dst: "/b", mode: defaultFileMode},
+		"c": {dst: "/d", mode: 0644, uid: 1, gid: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseFileSpecs = %+v, want %+v", got, want)
+	}
+}
+
+// TestLayerFromFilesReproducible verifies that two independent invocations
+// of layerFromFiles against the same inputs produce a byte-identical (and so
+// digest-identical) layer.
+func TestLayerFromFilesReproducible(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]fileSpec{
+		path: {dst: "/usr/local/bin/a.txt", mode: 0555, uid: 1000, gid: 1000},
+	}
+	tsr := &timestampResolver{mode: timestampFixed, fixed: time.Unix(1700000000, 0).UTC()}
+
+	digest := func() string {
+		l, err := layerFromFiles(noopLogf, files, types.OCILayer, tsr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.String()
+	}
+
+	d1 := digest()
+	d2 := digest()
+	if d1 != d2 {
+		t.Fatalf("layer digests differ across identical invocations: %v != %v", d1, d2)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+
+	r, err := parseTimestamp("zero", now)
+	if err != nil || !r.isZero() {
+		t.Fatalf("parseTimestamp(zero) = %+v, %v, want zero mode", r, err)
+	}
+
+	r, err = parseTimestamp("build", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.forImage(nil); err != nil || !got.Equal(now) {
+		t.Fatalf("parseTimestamp(build).forImage() = %v, %v, want %v", got, err, now)
+	}
+
+	r, err = parseTimestamp("1700000001", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Unix(1700000001, 0).UTC()
+	if got, err := r.forImage(nil); err != nil || !got.Equal(want) {
+		t.Fatalf("parseTimestamp(epoch).forImage() = %v, %v, want %v", got, err, want)
+	}
+
+	r, err = parseTimestamp("2023-11-14T22:13:20Z", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRFC3339 := time.Unix(1700000000, 0).UTC()
+	if got, err := r.forImage(nil); err != nil || !got.Equal(wantRFC3339) {
+		t.Fatalf("parseTimestamp(RFC3339).forImage() = %v, %v, want %v", got, err, wantRFC3339)
+	}
+
+	if _, err := parseTimestamp("not-a-timestamp", now); err == nil {
+		t.Fatal("expected error for an unparseable --timestamp value")
+	}
+}
+
+func TestTimestampSourceMode(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.txt")
+	newPath := filepath.Join(dir, "new.txt")
+	if err := os.WriteFile(oldPath, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-time.Hour)
+	newTime := time.Now()
+	if err := os.Chtimes(oldPath, oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(newPath, newTime, newTime); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := parseTimestamp("source", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotOld, err := r.forEntry(oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotNew, err := r.forEntry(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotNew.After(gotOld) {
+		t.Fatalf("forEntry(newPath) = %v, want after forEntry(oldPath) = %v", gotNew, gotOld)
+	}
+
+	files := map[string]fileSpec{oldPath: {dst: "/old"}, newPath: {dst: "/new"}}
+	created, err := r.forImage(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equal(gotNew) {
+		t.Fatalf("forImage() = %v, want the newest file's mtime %v", created, gotNew)
+	}
+}
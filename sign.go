@@ -0,0 +1,452 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const simpleSigningMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+// Default Sigstore public-good instances, used by --sign=keyless unless
+// overridden by --fulcio-url/--rekor-url (e.g. to point at a private
+// Sigstore deployment).
+const (
+	defaultFulcioURL = "https://fulcio.sigstore.dev"
+	defaultRekorURL  = "https://rekor.sigstore.dev"
+)
+
+// cosignPayload is the Sigstore "simple signing" payload format that cosign
+// signs and verifies.
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional struct{} `json:"optional"`
+}
+
+// loadCosignKey reads an ECDSA private key in PEM (PKCS#8) form from path.
+// KMS URIs (e.g. "awskms://...") are not yet supported.
+func loadCosignKey(path string) (*ecdsa.PrivateKey, error) {
+	if strings.Contains(path, "://") {
+		return nil, fmt.Errorf("KMS-backed cosign keys are not supported yet: %q", path)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cosign key: %w", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %q", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cosign key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("cosign key %q is not an ECDSA key", path)
+	}
+	return ecKey, nil
+}
+
+// cosignSign builds and signs a simple-signing payload for ref@digest,
+// returning the marshaled payload and its base64-encoded signature.
+func cosignSign(key *ecdsa.PrivateKey, ref name.Reference, digest v1.Hash) (payload, sig []byte, err error) {
+	var p cosignPayload
+	p.Critical.Identity.DockerReference = ref.Context().Name()
+	p.Critical.Image.DockerManifestDigest = digest.String()
+	p.Critical.Type = "cosign container image signature"
+	payload, err = json.Marshal(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(payload)
+	der, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	sig = []byte(base64.StdEncoding.EncodeToString(der))
+	return payload, sig, nil
+}
+
+// pushArtifact pushes data as a single-layer image of the given media type,
+// tagged "sha256-<hex digest>.<suffix>" in the same repository as ref. This
+// is the tag convention cosign uses for signatures and SBOMs.
+func pushArtifact(logf logf, repo name.Repository, digest v1.Hash, suffix string, data []byte, mediaType types.MediaType, annotations map[string]string, opts []remote.Option) error {
+	layer := static.NewLayer(data, mediaType)
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       layer,
+		Annotations: annotations,
+	})
+	if err != nil {
+		return err
+	}
+	tag := repo.Tag(fmt.Sprintf("%s-%s.%s", digest.Algorithm, digest.Hex, suffix))
+	logf("pushing %v to %v", suffix, tag)
+	return remote.Write(tag, img, opts...)
+}
+
+// pemEncodeECDSAPublicKey encodes pub as a PEM-wrapped SubjectPublicKeyInfo
+// block, the form cosign embeds in its signature annotations.
+func pemEncodeECDSAPublicKey(pub *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// signDigest signs ref@digest with key and pushes the resulting signature
+// artifact alongside it, with the base64 signature and the signer's public
+// key carried as layer annotations, matching cosign's own convention.
+func signDigest(logf logf, key *ecdsa.PrivateKey, ref name.Reference, digest v1.Hash, opts []remote.Option) error {
+	payload, sig, err := cosignSign(key, ref, digest)
+	if err != nil {
+		return fmt.Errorf("signing %v: %w", digest, err)
+	}
+	pubPEM, err := pemEncodeECDSAPublicKey(&key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("encoding public key: %w", err)
+	}
+	annotations := map[string]string{
+		"dev.cosignproject.cosign/signature": string(sig),
+		"dev.sigstore.cosign/certificate":    string(pubPEM),
+	}
+	return pushArtifact(logf, ref.Context(), digest, "sig", payload, simpleSigningMediaType, annotations, opts)
+}
+
+// getAmbientOIDCToken obtains an OIDC identity token from the ambient CI
+// environment, for --sign=keyless. Only the GitHub Actions workflow identity
+// flow is supported today: it exchanges ACTIONS_ID_TOKEN_REQUEST_TOKEN for a
+// token scoped to the sigstore audience via ACTIONS_ID_TOKEN_REQUEST_URL.
+// Outside of CI, cosign falls back to an interactive browser login; mkctr
+// does not implement that flow yet.
+func getAmbientOIDCToken() (string, error) {
+	reqURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	reqToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if reqURL == "" || reqToken == "" {
+		return "", fmt.Errorf("no ambient OIDC credentials found (expected GitHub Actions' ACTIONS_ID_TOKEN_REQUEST_URL/ACTIONS_ID_TOKEN_REQUEST_TOKEN); interactive browser-based OIDC login is not supported yet, run --sign=keyless from CI or use --sign=key instead")
+	}
+	req, err := http.NewRequest("GET", reqURL+"&audience=sigstore", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "bearer "+reqToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting ambient OIDC token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting ambient OIDC token: %s: %s", resp.Status, body)
+	}
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("parsing ambient OIDC token response: %w", err)
+	}
+	return out.Value, nil
+}
+
+// oidcTokenSubject extracts the "sub" claim from an OIDC identity token,
+// without verifying its signature: Fulcio itself verifies the token and
+// derives the certificate identity from it server-side. mkctr only needs
+// the subject to build the proof-of-possession Fulcio checks the signature
+// of against the same claim.
+func oidcTokenSubject(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed OIDC token: want 3 dot-separated parts, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decoding OIDC token payload: %w", err)
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("parsing OIDC token claims: %w", err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("OIDC token has no sub claim")
+	}
+	return claims.Subject, nil
+}
+
+// requestFulcioCert exchanges idToken and the ephemeral signing key pub for
+// a short-lived code-signing certificate, by proving possession of the
+// corresponding private key over a signature of the token's OIDC subject.
+func requestFulcioCert(fulcioURL, idToken string, key *ecdsa.PrivateKey) ([]byte, error) {
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := oidcTokenSubject(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("reading OIDC token: %w", err)
+	}
+	// Fulcio requires proof of possession of the private key: a signature,
+	// made with that key, over the OIDC token's own subject claim.
+	sum := sha256.Sum256([]byte(sub))
+	proof, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody, err := json.Marshal(map[string]any{
+		"credentials": map[string]string{"oidcIdentityToken": idToken},
+		"publicKeyRequest": map[string]any{
+			"publicKey": map[string]string{
+				"algorithm": "ECDSA",
+				"content":   base64.StdEncoding.EncodeToString(pubDER),
+			},
+			"proofOfPossession": base64.StdEncoding.EncodeToString(proof),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fulcioURL+"/api/v2/signingCert", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+idToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting fulcio certificate: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("requesting fulcio certificate: %s: %s", resp.Status, body)
+	}
+	var out struct {
+		SignedCertificateEmbeddedSct *struct {
+			Chain struct {
+				Certificates []string `json:"certificates"`
+			} `json:"chain"`
+		} `json:"signedCertificateEmbeddedSct"`
+		SignedCertificateDetachedSct *struct {
+			Chain struct {
+				Certificates []string `json:"certificates"`
+			} `json:"chain"`
+		} `json:"signedCertificateDetachedSct"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("parsing fulcio response: %w", err)
+	}
+	chain := out.SignedCertificateEmbeddedSct
+	if chain == nil {
+		chain = out.SignedCertificateDetachedSct
+	}
+	if chain == nil || len(chain.Chain.Certificates) == 0 {
+		return nil, fmt.Errorf("fulcio response contained no certificate chain")
+	}
+	return []byte(strings.Join(chain.Chain.Certificates, "\n")), nil
+}
+
+// uploadToRekor records payload's signature, verifiable against certPEM, in
+// the Rekor transparency log, returning the log entry's SignedEntryTimestamp
+// (the "SET"): Rekor's promise, countersigned by its own key, that the entry
+// was accepted into the log at a given time.
+func uploadToRekor(rekorURL string, payload, sig, certPEM []byte) ([]byte, error) {
+	sum := sha256.Sum256(payload)
+	reqBody, err := json.Marshal(map[string]any{
+		"kind":       "hashedrekord",
+		"apiVersion": "0.0.1",
+		"spec": map[string]any{
+			"signature": map[string]any{
+				"content":   base64.StdEncoding.EncodeToString(sig),
+				"publicKey": map[string]string{"content": base64.StdEncoding.EncodeToString(certPEM)},
+			},
+			"data": map[string]any{
+				"hash": map[string]string{
+					"algorithm": "sha256",
+					"value":     hex.EncodeToString(sum[:]),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(rekorURL+"/api/v1/log/entries", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("uploading to rekor: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("uploading to rekor: %s: %s", resp.Status, body)
+	}
+	// The response is a map of {uuid: logEntry}; there's exactly one entry
+	// for a freshly-created upload.
+	var entries map[string]struct {
+		Verification struct {
+			SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+		} `json:"verification"`
+	}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("parsing rekor response: %w", err)
+	}
+	for _, entry := range entries {
+		return entry.Verification.SignedEntryTimestamp, nil
+	}
+	return nil, fmt.Errorf("rekor response contained no log entries")
+}
+
+// signDigestKeyless signs ref@digest the same way signDigest does, except
+// with an ephemeral key and a short-lived Fulcio-issued certificate instead
+// of a long-lived user-supplied one, and with the resulting signature
+// recorded in Rekor instead of relying on the certificate's own expiry for
+// trust. The Rekor inclusion proof (the "SET") is embedded alongside the
+// signature so verifiers don't need to query Rekor themselves.
+func signDigestKeyless(logf logf, bp *buildParams, ref name.Reference, digest v1.Hash, opts []remote.Option) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating ephemeral signing key: %w", err)
+	}
+	idToken, err := getAmbientOIDCToken()
+	if err != nil {
+		return fmt.Errorf("keyless signing: %w", err)
+	}
+	certPEM, err := requestFulcioCert(bp.fulcioURL, idToken, key)
+	if err != nil {
+		return fmt.Errorf("keyless signing: %w", err)
+	}
+	payload, sig, err := cosignSign(key, ref, digest)
+	if err != nil {
+		return fmt.Errorf("signing %v: %w", digest, err)
+	}
+	set, err := uploadToRekor(bp.rekorURL, payload, sig, certPEM)
+	if err != nil {
+		return fmt.Errorf("keyless signing: %w", err)
+	}
+	annotations := map[string]string{
+		"dev.cosignproject.cosign/signature": string(sig),
+		"dev.sigstore.cosign/certificate":    string(certPEM),
+		"dev.sigstore.cosign/bundle":         base64.StdEncoding.EncodeToString(set),
+	}
+	return pushArtifact(logf, ref.Context(), digest, "sig", payload, simpleSigningMediaType, annotations, opts)
+}
+
+// generateSBOM produces an SBOM for ref, per bp.sbom:
+//   - "syft": shells out to the syft CLI to scan the pushed image.
+//   - anything else: treated as a path to an already-generated SBOM file.
+func generateSBOM(bp *buildParams, ref name.Reference) ([]byte, error) {
+	if bp.sbom == "syft" {
+		out, err := exec.Command("syft", ref.String(), "-o", "spdx-json").Output()
+		if err != nil {
+			return nil, fmt.Errorf("running syft: %w", err)
+		}
+		return out, nil
+	}
+	return os.ReadFile(bp.sbom)
+}
+
+// signAndAttest signs img@subject.Digest (if bp.sign is set) and attaches an
+// SBOM and/or provenance attestation (if bp.sbom/bp.provenance is set),
+// after it has already been pushed to ref. artifacts is whatever
+// createImageForBase/createImageFromRecipe already produced for the image
+// at subject.Digest; its fields are nil unless the corresponding flag was
+// set and this subject describes one (the top-level digest of a
+// multi-platform index describes no files or sources of its own, so it
+// gets an empty buildArtifacts — each child manifest already got its own).
+// Both must have been generated up front, since the files/sources they
+// describe no longer exist on disk by now.
+func signAndAttest(logf logf, bp *buildParams, ref name.Tag, subject v1.Descriptor, artifacts buildArtifacts, opts []remote.Option) error {
+	digest := subject.Digest
+	switch bp.sign {
+	case "", "none":
+	case "key":
+		key, err := loadCosignKey(bp.cosignKey)
+		if err != nil {
+			return err
+		}
+		if err := signDigest(logf, key, ref, digest, opts); err != nil {
+			return err
+		}
+	case "keyless":
+		if err := signDigestKeyless(logf, bp, ref, digest, opts); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported --sign value %q", bp.sign)
+	}
+	switch bp.sbom {
+	case "", "none":
+	case "spdx":
+		if artifacts.SPDXSBOM == nil {
+			// No SBOM was generated for this subject: it's the top-level
+			// digest of a multi-platform index, which describes no files of
+			// its own (each child manifest already got its own SBOM).
+			break
+		}
+		if err := pushSPDXReferrer(logf, ref.Context(), subject, artifacts.SPDXSBOM, opts); err != nil {
+			return fmt.Errorf("attaching spdx sbom: %w", err)
+		}
+	default:
+		sbom, err := generateSBOM(bp, ref)
+		if err != nil {
+			return fmt.Errorf("generating sbom: %w", err)
+		}
+		if err := pushArtifact(logf, ref.Context(), digest, "sbom", sbom, types.MediaType("text/spdx+json"), nil, opts); err != nil {
+			return err
+		}
+	}
+	if bp.provenance && artifacts.Provenance != nil {
+		envelope, annotations, err := signProvenance(bp, artifacts.Provenance)
+		if err != nil {
+			return fmt.Errorf("signing provenance: %w", err)
+		}
+		if err := pushProvenanceReferrer(logf, ref.Context(), subject, envelope, annotations, opts); err != nil {
+			return fmt.Errorf("attaching provenance: %w", err)
+		}
+	}
+	return nil
+}
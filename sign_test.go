@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func mustGenerateECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// TestCosignSign verifies that cosignSign produces a simple-signing payload
+// naming ref and digest, with a signature that verifies against the
+// signer's public key.
+func TestCosignSign(t *testing.T) {
+	key := mustGenerateECDSAKey(t)
+	ref, err := name.ParseReference("example.com/repo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := v1.Hash{Algorithm: "sha256", Hex: "0000000000000000000000000000000000000000000000000000000000aa"}
+
+	payload, sig, err := cosignSign(key, ref, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p cosignPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		t.Fatalf("payload isn't valid JSON: %v", err)
+	}
+	if p.Critical.Identity.DockerReference != ref.Context().Name() {
+		t.Fatalf("docker-reference = %q, want %q", p.Critical.Identity.DockerReference, ref.Context().Name())
+	}
+	if p.Critical.Image.DockerManifestDigest != digest.String() {
+		t.Fatalf("docker-manifest-digest = %q, want %q", p.Critical.Image.DockerManifestDigest, digest.String())
+	}
+
+	der, err := base64.StdEncoding.DecodeString(string(sig))
+	if err != nil {
+		t.Fatalf("signature isn't valid base64: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(&key.PublicKey, sum[:], der) {
+		t.Fatal("signature does not verify against the signer's public key")
+	}
+}
+
+// TestPemEncodeECDSAPublicKey verifies that pemEncodeECDSAPublicKey produces
+// a PEM block that parses back into the same public key.
+func TestPemEncodeECDSAPublicKey(t *testing.T) {
+	key := mustGenerateECDSAKey(t)
+	raw, err := pemEncodeECDSAPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(raw)
+	if block == nil {
+		t.Fatal("no PEM block found in output")
+	}
+	if len(rest) != 0 {
+		t.Fatalf("unexpected trailing data after PEM block: %q", rest)
+	}
+	if block.Type != "PUBLIC KEY" {
+		t.Fatalf("PEM block type = %q, want PUBLIC KEY", block.Type)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parsing encoded key: %v", err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || !ecPub.Equal(&key.PublicKey) {
+		t.Fatalf("decoded key = %+v, want %+v", pub, key.PublicKey)
+	}
+}
+
+// TestOIDCTokenSubject verifies that oidcTokenSubject extracts the "sub"
+// claim from a fabricated, unsigned JWT without needing to verify it.
+func TestOIDCTokenSubject(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"repo:tailscale/mkctr:ref:refs/heads/main"}`))
+	token := header + "." + payload + ".sig"
+
+	sub, err := oidcTokenSubject(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "repo:tailscale/mkctr:ref:refs/heads/main"; sub != want {
+		t.Fatalf("oidcTokenSubject = %q, want %q", sub, want)
+	}
+
+	if _, err := oidcTokenSubject("not-a-jwt"); err == nil {
+		t.Fatal("expected error for a malformed token, got nil")
+	}
+
+	noSub := base64.RawURLEncoding.EncodeToString([]byte(`{}`))
+	if _, err := oidcTokenSubject(header + "." + noSub + ".sig"); err == nil {
+		t.Fatal("expected error for a token with no sub claim, got nil")
+	}
+}
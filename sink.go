@@ -0,0 +1,202 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// sink is a destination that a built image or index can be written to.
+// fetchAndBuild writes to every sink configured on buildParams, instead of
+// hardcoding remote.Write/remote.WriteIndex, so a single build can be pushed
+// to a registry, loaded into a local daemon, and/or laid out on disk all in
+// one run.
+type sink interface {
+	// writeImage publishes a single-platform image under ref. artifacts is
+	// the pre-generated --sbom=spdx/--provenance attestations for img, if
+	// any, for sinks that attach them.
+	writeImage(logf logf, ref name.Tag, img v1.Image, artifacts buildArtifacts) error
+	// writeIndex publishes a multi-platform index under ref. artifactsByDigest
+	// maps each child manifest's digest to its pre-generated
+	// --sbom=spdx/--provenance attestations, if any.
+	writeIndex(logf logf, ref name.Tag, idx v1.ImageIndex, artifactsByDigest map[v1.Hash]buildArtifacts) error
+}
+
+// remoteSink pushes to a remote registry, optionally signing and/or
+// attaching an SBOM to whatever it pushes.
+type remoteSink struct {
+	opts []remote.Option
+	bp   *buildParams
+}
+
+func (s remoteSink) writeImage(logf logf, ref name.Tag, img v1.Image, artifacts buildArtifacts) error {
+	logf("pushing to %v", ref)
+	if err := remote.Write(ref, img, s.opts...); err != nil {
+		return err
+	}
+	d, err := partial.Descriptor(img)
+	if err != nil {
+		return err
+	}
+	return signAndAttest(logf, s.bp, ref, *d, artifacts, s.opts)
+}
+
+func (s remoteSink) writeIndex(logf logf, ref name.Tag, idx v1.ImageIndex, artifactsByDigest map[v1.Hash]buildArtifacts) error {
+	logf("pushing to %v", ref)
+	if err := remote.WriteIndex(ref, idx, s.opts...); err != nil {
+		return err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, m := range im.Manifests {
+		if err := signAndAttest(logf, s.bp, ref, m, artifactsByDigest[m.Digest], s.opts); err != nil {
+			return err
+		}
+	}
+	d, err := partial.Descriptor(idx)
+	if err != nil {
+		return err
+	}
+	return signAndAttest(logf, s.bp, ref, *d, buildArtifacts{}, s.opts)
+}
+
+// daemonSink loads images into a local Docker/containerd daemon. Daemons
+// don't understand multi-platform indexes, so writeIndex loads each child
+// manifest under the same tag in turn.
+type daemonSink struct{}
+
+func (daemonSink) writeImage(logf logf, ref name.Tag, img v1.Image, artifacts buildArtifacts) error {
+	return loadLocalImage(logf, ref, img)
+}
+
+func (s daemonSink) writeIndex(logf logf, ref name.Tag, idx v1.ImageIndex, artifactsByDigest map[v1.Hash]buildArtifacts) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, m := range im.Manifests {
+		child, err := idx.Image(m.Digest)
+		if err != nil {
+			return err
+		}
+		if err := s.writeImage(logf, ref, child, artifactsByDigest[m.Digest]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ociLayoutSink writes an OCI image layout to a directory on disk, for
+// hermetic builds and tools (kind, minikube, skopeo) that can load a layout
+// without a registry round-trip.
+type ociLayoutSink struct {
+	path string
+}
+
+func (s ociLayoutSink) writeImage(logf logf, ref name.Tag, img v1.Image, artifacts buildArtifacts) error {
+	if err := createOutDirectory(s.path); err != nil {
+		return err
+	}
+	logf("writing to OCI layout %v", s.path)
+	p, err := layout.FromPath(s.path)
+	if err != nil {
+		if p, err = layout.Write(s.path, empty.Index); err != nil {
+			return err
+		}
+	}
+	return p.AppendImage(img)
+}
+
+func (s ociLayoutSink) writeIndex(logf logf, ref name.Tag, idx v1.ImageIndex, artifactsByDigest map[v1.Hash]buildArtifacts) error {
+	if err := createOutDirectory(s.path); err != nil {
+		return err
+	}
+	logf("writing index to OCI layout %v", s.path)
+	_, err := layout.Write(s.path, idx)
+	return err
+}
+
+// outPathSink preserves the existing --out behavior: a docker-loadable tar
+// for a single image, or an OCI layout for a multi-platform index.
+type outPathSink struct {
+	path string
+}
+
+func (s outPathSink) writeImage(logf logf, ref name.Tag, img v1.Image, artifacts buildArtifacts) error {
+	return writeImageToFile(img, ref, s.path)
+}
+
+func (s outPathSink) writeIndex(logf logf, ref name.Tag, idx v1.ImageIndex, artifactsByDigest map[v1.Hash]buildArtifacts) error {
+	if err := createOutDirectory(s.path); err != nil {
+		return err
+	}
+	_, err := layout.Write(s.path, idx)
+	return err
+}
+
+// sinks returns the set of destinations this build should be written to,
+// based on the flags set on bp.
+func (bp *buildParams) sinks(remoteOpts []remote.Option) []sink {
+	var sinks []sink
+	if bp.target == "local" || bp.daemon {
+		sinks = append(sinks, daemonSink{})
+	}
+	if bp.publish && bp.target != "local" {
+		sinks = append(sinks, remoteSink{opts: remoteOpts, bp: bp})
+	}
+	if bp.ociLayoutPath != "" {
+		sinks = append(sinks, ociLayoutSink{path: bp.ociLayoutPath})
+	}
+	if bp.outPath != "" {
+		sinks = append(sinks, outPathSink{path: bp.outPath})
+	}
+	return sinks
+}
+
+// writeToSinks writes img to every configured sink, under every configured
+// image ref. artifacts is img's pre-generated --sbom=spdx/--provenance
+// attestations, if any, passed through to sinks that attach them.
+func writeToSinks(sinks []sink, logf logf, refs []name.Tag, img v1.Image, artifacts buildArtifacts) error {
+	if len(sinks) == 0 {
+		logf("not pushing or writing to file")
+		return nil
+	}
+	for _, s := range sinks {
+		for _, r := range refs {
+			if err := s.writeImage(logf, r, img, artifacts); err != nil {
+				return fmt.Errorf("writing image to sink: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeIndexToSinks writes idx to every configured sink, under every
+// configured image ref. artifactsByDigest maps each child manifest's digest
+// to its pre-generated --sbom=spdx/--provenance attestations, if any,
+// passed through to sinks that attach them.
+func writeIndexToSinks(sinks []sink, logf logf, refs []name.Tag, idx v1.ImageIndex, artifactsByDigest map[v1.Hash]buildArtifacts) error {
+	if len(sinks) == 0 {
+		logf("not pushing or writing to file")
+		return nil
+	}
+	for _, s := range sinks {
+		for _, r := range refs {
+			if err := s.writeIndex(logf, r, idx, artifactsByDigest); err != nil {
+				return fmt.Errorf("writing index to sink: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// spdxMediaType is the artifactType mkctr stamps on its self-generated SBOM
+// referrer manifests, per the OCI 1.1 "artifact" convention.
+const spdxMediaType types.MediaType = "application/spdx+json"
+
+// spdxDocument is the subset of the SPDX 2.3 JSON schema mkctr emits: one
+// package per file baked into the image, plus one per Go module pulled in by
+// a compiled binary among them.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// generateSPDXSBOM builds an SPDX 2.3 JSON document describing every file in
+// files: its container path, sha256, and size, plus — for entries that are
+// compiled Go binaries — the module versions baked into them, as reported by
+// debug/buildinfo.ReadFile.
+func generateSPDXSBOM(docName string, files map[string]fileSpec) ([]byte, error) {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              docName,
+		DocumentNamespace: "https://github.com/tailscale/mkctr/spdx/" + docName,
+		CreationInfo:      spdxCreationInfo{Creators: []string{"Tool: mkctr"}},
+	}
+
+	var srcs []string
+	for src := range files {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+
+	modules := map[string]spdxPackage{} // keyed by "path@version", deduped across binaries
+	for i, src := range srcs {
+		spec := files[src]
+		sum, err := sha256File(src)
+		if err != nil {
+			return nil, fmt.Errorf("sbom: hashing %v: %w", spec.dst, err)
+		}
+		fileID := fmt.Sprintf("SPDXRef-file-%d", i)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           fileID,
+			Name:             spec.dst,
+			DownloadLocation: "NOASSERTION",
+			FilesAnalyzed:    false,
+			Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: sum}},
+			CopyrightText:    "NOASSERTION",
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      doc.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: fileID,
+		})
+
+		info, err := buildinfo.ReadFile(src)
+		if err != nil {
+			// Not a Go binary (or not readable as one); just a plain file.
+			continue
+		}
+		for _, dep := range info.Deps {
+			key := dep.Path + "@" + dep.Version
+			modID, ok := modules[key]
+			if !ok {
+				modID = spdxPackage{
+					SPDXID:           fmt.Sprintf("SPDXRef-module-%d", len(modules)),
+					Name:             dep.Path,
+					VersionInfo:      dep.Version,
+					DownloadLocation: "NOASSERTION",
+					FilesAnalyzed:    false,
+					CopyrightText:    "NOASSERTION",
+				}
+				modules[key] = modID
+			}
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      fileID,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: modID.SPDXID,
+			})
+		}
+	}
+
+	var modKeys []string
+	for key := range modules {
+		modKeys = append(modKeys, key)
+	}
+	sort.Strings(modKeys)
+	for _, key := range modKeys {
+		doc.Packages = append(doc.Packages, modules[key])
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// pushSPDXReferrer pushes an already-generated SPDX SBOM to repo as an OCI
+// 1.1 referrer artifact: a manifest whose subject points at subject and
+// whose artifactType is spdxMediaType, so tools like `crane manifest
+// --filter-annotation` or `oras discover` can find it without knowing its
+// digest up front. sbom must have been generated by generateSPDXSBOM while
+// the files it describes were still on disk: by the time a built image has
+// been pushed, createImageForBase's temporary gopath build directory is
+// long gone.
+func pushSPDXReferrer(logf logf, repo name.Repository, subject v1.Descriptor, sbom []byte, opts []remote.Option) error {
+	img, err := mutate.Append(empty.Image, mutate.Addendum{Layer: static.NewLayer(sbom, spdxMediaType)})
+	if err != nil {
+		return err
+	}
+	img = mutate.ConfigMediaType(img, spdxMediaType)
+	img = mutate.Subject(img, subject).(v1.Image)
+
+	d, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	ref := repo.Digest(d.String())
+	logf("pushing spdx sbom referrer for %v to %v", subject.Digest, ref)
+	return remote.Write(ref, img, opts...)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateSPDXSBOM(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]fileSpec{
+		path: {dst: "/usr/local/bin/a.txt", mode: 0555},
+	}
+
+	raw, err := generateSPDXSBOM("test-doc", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc spdxDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("generated SBOM isn't valid JSON: %v", err)
+	}
+	if doc.SPDXVersion != "SPDX-2.3" {
+		t.Fatalf("SPDXVersion = %q, want SPDX-2.3", doc.SPDXVersion)
+	}
+	if len(doc.Packages) != 1 {
+		t.Fatalf("got %d packages, want 1", len(doc.Packages))
+	}
+	pkg := doc.Packages[0]
+	if pkg.Name != "/usr/local/bin/a.txt" {
+		t.Fatalf("package name = %q, want /usr/local/bin/a.txt", pkg.Name)
+	}
+	if len(pkg.Checksums) != 1 || pkg.Checksums[0].Algorithm != "SHA256" {
+		t.Fatalf("package checksums = %+v, want one SHA256 entry", pkg.Checksums)
+	}
+}
+
+// TestGenerateSPDXSBOMGoBinary verifies that a file which is actually a
+// compiled Go binary (the running test binary itself) contributes module
+// packages and a DEPENDS_ON relationship to the SBOM.
+func TestGenerateSPDXSBOMGoBinary(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Skipf("os.Executable: %v", err)
+	}
+	files := map[string]fileSpec{
+		self: {dst: "/usr/local/bin/mkctr-test", mode: 0555},
+	}
+	raw, err := generateSPDXSBOM("test-doc", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc spdxDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("generated SBOM isn't valid JSON: %v", err)
+	}
+	var sawDependsOn bool
+	for _, rel := range doc.Relationships {
+		if rel.RelationshipType == "DEPENDS_ON" {
+			sawDependsOn = true
+			break
+		}
+	}
+	if !sawDependsOn {
+		t.Fatalf("expected at least one DEPENDS_ON relationship for a Go binary's modules, got %+v", doc.Relationships)
+	}
+}